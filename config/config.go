@@ -110,6 +110,7 @@ func (c *dbConnectorConfig) TenantProviderConfig() TenantProviderConfig {
 type simpleConfigTenantProvider struct {
 	url      string
 	tenantID string
+	metadata dbconnector.TenantMetadata
 }
 
 // Configure implements dbconnector.TenantProvider.
@@ -123,7 +124,8 @@ func (p *simpleConfigTenantProvider) LoadTenants() ([]dbconnector.TenantConfig,
 		dbconnector.NewTenantConfigBuilder().
 			WithTenantID(p.tenantID).
 			WithTenantName("__Default").
-			WithDatabaseURL(p.url).Build(),
+			WithDatabaseURL(p.url).
+			WithMetadata(p.metadata).Build(),
 	}
 
 	return tenants, nil
@@ -137,3 +139,13 @@ func NewSimpleConfigTenantProvider(url string, tenantID string) dbconnector.Tena
 		tenantID: tenantID,
 	}
 }
+
+// NewSimpleConfigTenantProviderWithMetadata creates a new tenant provider with a simple configuration
+// and the metadata of its tenant.
+func NewSimpleConfigTenantProviderWithMetadata(url string, tenantID string, metadata dbconnector.TenantMetadata) dbconnector.TenantProvider {
+	return &simpleConfigTenantProvider{
+		url:      url,
+		tenantID: tenantID,
+		metadata: metadata,
+	}
+}
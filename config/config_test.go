@@ -26,6 +26,7 @@ package config_test
 import (
 	"testing"
 
+	"github.com/fkmatsuda/dbconnector"
 	"github.com/fkmatsuda/dbconnector/config"
 
 	"github.com/stretchr/testify/assert"
@@ -61,3 +62,34 @@ func TestSimpleConfigTenantProviderConfig(t *testing.T) {
 		assert.Equal(t, "__Default", tenants[0].TenantName())
 	})
 }
+
+func TestSimpleConfigTenantProviderWithMetadata(t *testing.T) {
+
+	const databaseUrl = "pgsql://localhost:5432/pgtest?sslmode=disable"
+	const tenantId = "simple"
+
+	t.Run("Test SimpleConfigTenantProviderWithMetadata", func(t *testing.T) {
+		provider := config.NewSimpleConfigTenantProviderWithMetadata(databaseUrl, tenantId, dbconnector.TenantMetadata{
+			Region: "eu-west",
+			Tier:   "gold",
+			Labels: map[string]string{"plan": "enterprise"},
+		})
+		assert.NotNil(t, provider)
+		tenants, err := provider.LoadTenants()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(tenants))
+		metadata := dbconnector.TenantMetadataOf(tenants[0])
+		assert.Equal(t, "eu-west", metadata.Region)
+		assert.Equal(t, "gold", metadata.Tier)
+		assert.Equal(t, dbconnector.TenantStatusActive, metadata.Status)
+
+		selector, err := dbconnector.ParseLabelSelector("plan=enterprise, !trial")
+		assert.NoError(t, err)
+		assert.Len(t, dbconnector.FilterTenants(tenants, selector), 1)
+		selector, err = dbconnector.ParseLabelSelector("plan!=enterprise")
+		assert.NoError(t, err)
+		assert.Len(t, dbconnector.FilterTenants(tenants, selector), 0)
+		_, err = dbconnector.ParseLabelSelector("=enterprise")
+		assert.Error(t, err)
+	})
+}
@@ -26,6 +26,8 @@ package dbconnector
 
 import (
 	"context"
+
+	"github.com/fkmatsuda/errorex"
 )
 
 // TenantConfig is the configuration for a tenant.
@@ -38,6 +40,50 @@ type TenantConfig interface {
 	DatabaseURL() string
 }
 
+// TenantSchemaConfig is implemented by tenant configs whose tables live in a
+// dedicated schema of a database shared with other tenants.
+type TenantSchemaConfig interface {
+	// Schema is the schema of the tenant.
+	Schema() string
+}
+
+// TenantSchema returns the schema of the tenant, or "" when the tenant owns its database.
+func TenantSchema(config TenantConfig) string {
+	if schemaConfig, ok := config.(TenantSchemaConfig); ok {
+		return schemaConfig.Schema()
+	}
+	return ""
+}
+
+// TenantSessionConfig is implemented by tenant configs that set session variables,
+// e.g. the ones read by row-level security policies through current_setting().
+type TenantSessionConfig interface {
+	// SessionVariables returns the session variables by name.
+	SessionVariables() map[string]string
+}
+
+// TenantSessionVariables returns the session variables of the tenant.
+func TenantSessionVariables(config TenantConfig) map[string]string {
+	if sessionConfig, ok := config.(TenantSessionConfig); ok {
+		return sessionConfig.SessionVariables()
+	}
+	return nil
+}
+
+// TenantReplicaConfig is implemented by tenant configs whose database has read replicas.
+type TenantReplicaConfig interface {
+	// ReplicaURLs returns the URLs of the read replicas, DatabaseURL being the primary.
+	ReplicaURLs() []string
+}
+
+// TenantReplicaURLs returns the URLs of the read replicas of the tenant.
+func TenantReplicaURLs(config TenantConfig) []string {
+	if replicaConfig, ok := config.(TenantReplicaConfig); ok {
+		return replicaConfig.ReplicaURLs()
+	}
+	return nil
+}
+
 // TenantProviderConfig is the configuration for the tenant provider.
 type TenantProviderConfig struct {
 	// URL is the URL of the tenant provider.
@@ -55,7 +101,24 @@ type Result interface {
 	RowsAffected() (int64, error)
 }
 
+// KeyResult is implemented by results that capture the generated key of an insert
+// (see ReturningIDExecutor).
+type KeyResult interface {
+	// LastInsertKey returns the last inserted key, which may be an int64 or a UUID string.
+	LastInsertKey() (interface{}, error)
+}
+
+// LastInsertKey returns the last inserted key of the result, or its last inserted ID
+// when it does not capture keys.
+func LastInsertKey(result Result) (interface{}, error) {
+	if keyResult, ok := result.(KeyResult); ok {
+		return keyResult.LastInsertKey()
+	}
+	return result.LastInsertId()
+}
+
 // TransactionFN is the transaction function.
+// Its context carries the tenant ID and the transaction (see TransactionFromContext).
 type TransactionFN func(ctx context.Context, tx Transaction) error
 
 // Row is a row in the result set.
@@ -78,6 +141,16 @@ type Rows interface {
 	Close() error
 }
 
+// ValueRows is implemented by result sets that expose their columns and decoded values,
+// as needed by QueryTenants.
+type ValueRows interface {
+	// Columns returns the names of the columns.
+	Columns() []string
+
+	// Values returns the decoded values of the current row.
+	Values() ([]interface{}, error)
+}
+
 // Query is the query interface.
 type Query interface {
 
@@ -85,12 +158,27 @@ type Query interface {
 	TenantConfig() TenantConfig
 
 	// Query executes a query and returns the result.
+	// Passing a NamedArgsBinder as the only argument binds :name and @name placeholders.
 	Query(ctx context.Context, query string, args ...interface{}) (Rows, error)
 
 	// QueryRow executes a query that is expected to return at most one row.
 	QueryRow(ctx context.Context, query string, args ...interface{}) Row
 }
 
+// StatementRunner is implemented by databases and transactions that run statements
+// registered by name with their connector.
+type StatementRunner interface {
+	// QueryStatement executes a registered statement and returns the result.
+	QueryStatement(ctx context.Context, name string, args ...interface{}) (Rows, error)
+
+	// QueryRowStatement executes a registered statement that is expected to return at most one row.
+	QueryRowStatement(ctx context.Context, name string, args ...interface{}) Row
+
+	// ExecStatement executes a registered statement without returning any rows, outside
+	// a transaction unless run by one.
+	ExecStatement(ctx context.Context, name string, args ...interface{}) (Result, error)
+}
+
 // Transaction is a database transaction.
 type Transaction interface {
 	Query
@@ -99,6 +187,14 @@ type Transaction interface {
 	Exec(ctx context.Context, query string, args ...interface{}) (Result, error)
 }
 
+// ReturningIDExecutor is implemented by transactions that capture generated keys.
+type ReturningIDExecutor interface {
+	// ExecReturningID executes an insert and captures the generated key of the last inserted row.
+	// A RETURNING clause is appended for the id column unless the query already has one,
+	// in which case its first column is taken as the key. The result is a KeyResult.
+	ExecReturningID(ctx context.Context, query string, args ...interface{}) (Result, error)
+}
+
 // TransactionFN is the transaction function.
 
 // Database is the database interface.
@@ -106,12 +202,29 @@ type Database interface {
 	Query
 
 	// RunInTransaction executes the given function in a transaction.
+	// When ctx already carries a transaction of the same tenant, fn joins it.
+	// The transaction is read-only when ctx asks for it (see WithReadOnly).
 	RunInTransaction(ctx context.Context, fn TransactionFN) error
 
 	// Close closes the database.
 	Close(ctx context.Context) error
 }
 
+// Executor is implemented by databases that execute queries outside a transaction.
+type Executor interface {
+	// Exec executes a query without returning any rows, outside a transaction.
+	Exec(ctx context.Context, query string, args ...interface{}) (Result, error)
+}
+
+// Exec executes a query without returning any rows outside a transaction, which the
+// database must support (see Executor).
+func Exec(ctx context.Context, database Database, query string, args ...interface{}) (Result, error) {
+	if executor, ok := database.(Executor); ok {
+		return executor.Exec(ctx, query, args...)
+	}
+	return nil, errorex.New(ErrCodeNotSupported, TenantErrorDetail{TenantID: database.TenantConfig().TenantID()})
+}
+
 // Connector is the database connector.
 type Connector interface {
 	// Connect connects to the database.
@@ -121,6 +234,44 @@ type Connector interface {
 	Reload() error
 }
 
+// ReadOnlyConnector is implemented by connectors that route read-only connections to replicas.
+type ReadOnlyConnector interface {
+	// ConnectReadOnly connects to a healthy read replica of the tenant, or to its primary
+	// when it has none available. Transactions are read-only and Exec is rejected.
+	ConnectReadOnly(ctx context.Context, tenantID string) (Database, error)
+}
+
+// ConnectReadOnly connects to a read replica of the tenant, which the connector must
+// support (see ReadOnlyConnector).
+func ConnectReadOnly(ctx context.Context, connector Connector, tenantID string) (Database, error) {
+	if readOnlyConnector, ok := connector.(ReadOnlyConnector); ok {
+		return readOnlyConnector.ConnectReadOnly(ctx, tenantID)
+	}
+	return nil, errorex.New(ErrCodeNotSupported, TenantErrorDetail{TenantID: tenantID})
+}
+
+// TenantLister is implemented by connectors that expose their current tenants.
+type TenantLister interface {
+	// Tenant returns the current config of a tenant.
+	Tenant(tenantID string) (TenantConfig, bool)
+
+	// Tenants returns the current tenants.
+	Tenants() []TenantConfig
+}
+
+// ConnectorCloser is implemented by connectors that hold database pools to close.
+type ConnectorCloser interface {
+	// Close closes the database pools.
+	Close()
+}
+
+// CloseConnector closes the database pools of the connector, if it holds any (see ConnectorCloser).
+func CloseConnector(connector Connector) {
+	if closer, ok := connector.(ConnectorCloser); ok {
+		closer.Close()
+	}
+}
+
 // TenantProvider is the tenant provider interface.
 type TenantProvider interface {
 	// Configure configures the tenant provider.
@@ -132,9 +283,13 @@ type TenantProvider interface {
 
 // tenantConfigImpl is a TenantConfig implementation.
 type tenantConfigImpl struct {
-	id   string
-	name string
-	url  string
+	id        string
+	name      string
+	url       string
+	schema    string
+	variables map[string]string
+	metadata  TenantMetadata
+	replicas  []string
 }
 
 // TenantID implements dbconnector.TenantConfig.
@@ -152,6 +307,26 @@ func (c *tenantConfigImpl) DatabaseURL() string {
 	return c.url
 }
 
+// Schema implements dbconnector.TenantSchemaConfig.
+func (c *tenantConfigImpl) Schema() string {
+	return c.schema
+}
+
+// SessionVariables implements dbconnector.TenantSessionConfig.
+func (c *tenantConfigImpl) SessionVariables() map[string]string {
+	return c.variables
+}
+
+// Metadata implements dbconnector.TenantMetadataConfig.
+func (c *tenantConfigImpl) Metadata() TenantMetadata {
+	return c.metadata
+}
+
+// ReplicaURLs implements dbconnector.TenantReplicaConfig.
+func (c *tenantConfigImpl) ReplicaURLs() []string {
+	return c.replicas
+}
+
 // TeanantConfigBuilder is a builder for TenantConfig.
 type TenantConfigBuilder interface {
 	// WithTenantID sets the tenant ID.
@@ -160,6 +335,24 @@ type TenantConfigBuilder interface {
 	WithTenantName(name string) TenantConfigBuilder
 	// WithDatabaseURL sets the database URL.
 	WithDatabaseURL(url string) TenantConfigBuilder
+	// WithSchema sets the schema of a tenant that shares its database with other tenants.
+	WithSchema(schema string) TenantConfigBuilder
+	// WithSessionVariable sets a session variable, e.g. app.tenant_id for row-level security.
+	WithSessionVariable(name, value string) TenantConfigBuilder
+	// WithMetadata sets the whole metadata.
+	WithMetadata(metadata TenantMetadata) TenantConfigBuilder
+	// WithRegion sets the region.
+	WithRegion(region string) TenantConfigBuilder
+	// WithTier sets the service tier.
+	WithTier(tier string) TenantConfigBuilder
+	// WithStatus sets the operational status.
+	WithStatus(status TenantStatus) TenantConfigBuilder
+	// WithLabel sets a label.
+	WithLabel(key, value string) TenantConfigBuilder
+	// WithConnectionSettings sets the connection pool settings.
+	WithConnectionSettings(settings ConnectionSettings) TenantConfigBuilder
+	// WithReplicaURL adds the URL of a read replica.
+	WithReplicaURL(url string) TenantConfigBuilder
 	// Build creates a TenantConfig.
 	Build() TenantConfig
 }
@@ -186,6 +379,66 @@ func (b *tenantConfigBuilder) WithDatabaseURL(url string) TenantConfigBuilder {
 	return b
 }
 
+// WithSchema implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithSchema(schema string) TenantConfigBuilder {
+	b.tenantConfig.schema = schema
+	return b
+}
+
+// WithSessionVariable implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithSessionVariable(name, value string) TenantConfigBuilder {
+	if b.tenantConfig.variables == nil {
+		b.tenantConfig.variables = make(map[string]string)
+	}
+	b.tenantConfig.variables[name] = value
+	return b
+}
+
+// WithMetadata implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithMetadata(metadata TenantMetadata) TenantConfigBuilder {
+	b.tenantConfig.metadata = metadata
+	return b
+}
+
+// WithRegion implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithRegion(region string) TenantConfigBuilder {
+	b.tenantConfig.metadata.Region = region
+	return b
+}
+
+// WithTier implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithTier(tier string) TenantConfigBuilder {
+	b.tenantConfig.metadata.Tier = tier
+	return b
+}
+
+// WithStatus implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithStatus(status TenantStatus) TenantConfigBuilder {
+	b.tenantConfig.metadata.Status = status
+	return b
+}
+
+// WithLabel implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithLabel(key, value string) TenantConfigBuilder {
+	if b.tenantConfig.metadata.Labels == nil {
+		b.tenantConfig.metadata.Labels = make(map[string]string)
+	}
+	b.tenantConfig.metadata.Labels[key] = value
+	return b
+}
+
+// WithConnectionSettings implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithConnectionSettings(settings ConnectionSettings) TenantConfigBuilder {
+	b.tenantConfig.metadata.ConnectionSettings = settings
+	return b
+}
+
+// WithReplicaURL implements TenantConfigBuilder.
+func (b *tenantConfigBuilder) WithReplicaURL(url string) TenantConfigBuilder {
+	b.tenantConfig.replicas = append(b.tenantConfig.replicas, url)
+	return b
+}
+
 // Build implements TenantConfigBuilder.
 func (b *tenantConfigBuilder) Build() TenantConfig {
 	return &b.tenantConfig
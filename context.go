@@ -0,0 +1,156 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"context"
+	"time"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+// contextKey is the type of the context keys of this package.
+type contextKey int
+
+const (
+	tenantContextKey contextKey = iota
+	transactionContextKey
+	databaseContextKey
+	readOnlyContextKey
+	minLSNContextKey
+	staleReadContextKey
+	attemptContextKey
+)
+
+// WithTenant returns a copy of ctx that carries the tenant ID.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey, tenantID)
+}
+
+// TenantFromContext returns the tenant ID carried by ctx.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantContextKey).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// ConnectFromContext connects to the database of the tenant carried by ctx (see WithTenant).
+func ConnectFromContext(ctx context.Context, connector Connector) (Database, error) {
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, errorex.New(ErrCodeMissingTenant, TenantErrorDetail{})
+	}
+	return connector.Connect(ctx, tenantID)
+}
+
+// WithTransaction returns a copy of ctx that carries the transaction and its tenant ID.
+// Transaction functions receive such a context, so that code down the call chain
+// can join the ambient transaction instead of opening a new one.
+func WithTransaction(ctx context.Context, tx Transaction) context.Context {
+	ctx = WithTenant(ctx, tx.TenantConfig().TenantID())
+	return context.WithValue(ctx, transactionContextKey, tx)
+}
+
+// TransactionFromContext returns the transaction carried by ctx.
+func TransactionFromContext(ctx context.Context) (Transaction, bool) {
+	tx, ok := ctx.Value(transactionContextKey).(Transaction)
+	return tx, ok
+}
+
+// WithDatabase returns a copy of ctx that carries the database and its tenant ID.
+func WithDatabase(ctx context.Context, database Database) context.Context {
+	ctx = WithTenant(ctx, database.TenantConfig().TenantID())
+	return context.WithValue(ctx, databaseContextKey, database)
+}
+
+// DatabaseFromContext returns the database carried by ctx.
+func DatabaseFromContext(ctx context.Context) (Database, bool) {
+	database, ok := ctx.Value(databaseContextKey).(Database)
+	return database, ok
+}
+
+// AmbientTransaction returns the transaction carried by ctx when it belongs to the given tenant.
+func AmbientTransaction(ctx context.Context, tenantID string) (Transaction, bool) {
+	tx, ok := TransactionFromContext(ctx)
+	if !ok || tx.TenantConfig().TenantID() != tenantID {
+		return nil, false
+	}
+	return tx, true
+}
+
+// WithReadOnly returns a copy of ctx in which the transactions started by RunInTransaction are read-only.
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyContextKey, true)
+}
+
+// ReadOnlyFromContext reports whether ctx asks for read-only transactions.
+func ReadOnlyFromContext(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyContextKey).(bool)
+	return readOnly
+}
+
+// WithMinLSN returns a copy of ctx that only accepts the read replicas that replayed the WAL
+// up to the LSN, e.g. the position of the primary after a write that should be read back.
+func WithMinLSN(ctx context.Context, lsn string) context.Context {
+	return context.WithValue(ctx, minLSNContextKey, lsn)
+}
+
+// MinLSNFromContext returns the LSN carried by ctx, or "".
+func MinLSNFromContext(ctx context.Context) string {
+	lsn, _ := ctx.Value(minLSNContextKey).(string)
+	return lsn
+}
+
+// StaleRead allows reads that may miss the latest writes in exchange for cheaper reads.
+type StaleRead struct {
+	// Staleness is how long ago the data is read. When zero, the backend picks the
+	// freshest time it can read cheaply.
+	Staleness time.Duration
+}
+
+// WithStaleRead returns a copy of ctx that allows stale reads. CockroachDB databases read
+// as of the staleness, or follower_read_timestamp() without one, in Query, QueryRow and
+// RunInTransaction; bounded staleness (with_max_staleness) is not offered, as it only applies
+// to single statements outside of a transaction. Postgres databases read the primary as usual,
+// while ConnectReadOnly leaves out the replicas lagging beyond the staleness, and falls back to
+// the primary when the lag of the replicas is not measured.
+func WithStaleRead(ctx context.Context, staleRead StaleRead) context.Context {
+	return context.WithValue(ctx, staleReadContextKey, staleRead)
+}
+
+// StaleReadFromContext returns the stale reads allowed by ctx.
+func StaleReadFromContext(ctx context.Context) (StaleRead, bool) {
+	staleRead, ok := ctx.Value(staleReadContextKey).(StaleRead)
+	return staleRead, ok
+}
+
+// WithAttempt returns a copy of ctx that carries the attempt of a retried transaction, counting from 1.
+func WithAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptContextKey, attempt)
+}
+
+// AttemptFromContext returns the attempt of the retried transaction carried by ctx, 0 outside of one.
+func AttemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptContextKey).(int)
+	return attempt
+}
@@ -33,21 +33,24 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
+// Backend names the connector in the pool statistics.
+const Backend = "crdb"
+
 // CrdbConnector is the struct for the CockroachDB connector.
 type CrdbConnector struct {
-	pgsql_connector.PgsqlConnector
+	*pgsql_connector.PgsqlConnector
 }
 
 // NewConnector creates a new database connector.
-func NewConnector(tenantProvider dbconnector.TenantProvider) (dbconnector.Connector, error) {
+func NewConnector(tenantProvider dbconnector.TenantProvider, opts ...pgsql_connector.Option) (dbconnector.Connector, error) {
 	// get PgsqlConnector
-	connector, err := pgsql_connector.NewConnector(tenantProvider)
+	connector, err := pgsql_connector.NewConnector(tenantProvider, opts...)
 	if err != nil {
 		return nil, err
 	}
 	// create crdb connector
 	crdbConnector := CrdbConnector{
-		PgsqlConnector: *(connector.(*pgsql_connector.PgsqlConnector)),
+		PgsqlConnector: connector.(*pgsql_connector.PgsqlConnector),
 	}
 	return &crdbConnector, nil
 }
@@ -64,22 +67,90 @@ func (c *CrdbConnector) Connect(ctx context.Context, tenantID string) (dbconnect
 	if err != nil {
 		return nil, err
 	}
+	return newCrdbDatabase(database), nil
+}
+
+// override PgsqlConnector.ConnectReadOnly
+func (c *CrdbConnector) ConnectReadOnly(ctx context.Context, tenantID string) (dbconnector.Database, error) {
+	database, err := c.PgsqlConnector.ConnectReadOnly(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return newCrdbDatabase(database), nil
+}
+
+// override PgsqlConnector.ConnectConfig
+func (c *CrdbConnector) ConnectConfig(ctx context.Context, tenantConfig dbconnector.TenantConfig) (dbconnector.Database, error) {
+	database, err := c.PgsqlConnector.ConnectConfig(ctx, tenantConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newCrdbDatabase(database), nil
+}
+
+func newCrdbDatabase(database dbconnector.Database) *CrdbDatabase {
 	// create crdb database
 	crdbDatabase := CrdbDatabase{
 		PgsqlDatabase: *(database.(*pgsql_connector.PgsqlDatabase)),
 	}
-	return &crdbDatabase, nil
+	return &crdbDatabase
+}
+
+// override PgsqlConnector.ConnectFromContext
+func (c *CrdbConnector) ConnectFromContext(ctx context.Context) (dbconnector.Database, error) {
+	return dbconnector.ConnectFromContext(ctx, c)
+}
+
+// override PgsqlConnector.ForEachTenant
+func (c *CrdbConnector) ForEachTenant(ctx context.Context, opts dbconnector.ForEachOptions, fn dbconnector.TenantFunc) *dbconnector.ForEachResult {
+	return dbconnector.ForEachTenant(ctx, c, opts, fn)
+}
+
+// override PgsqlConnector.Stats
+func (c *CrdbConnector) Stats() []dbconnector.PoolStats {
+	stats := c.PgsqlConnector.Stats()
+	for i := range stats {
+		stats[i].Backend = Backend
+	}
+	return stats
+}
+
+// override PgsqlConnector.QueryStats
+func (c *CrdbConnector) QueryStats() []dbconnector.QueryStats {
+	stats := c.PgsqlConnector.QueryStats()
+	for i := range stats {
+		stats[i].Backend = Backend
+	}
+	return stats
 }
 
 // override PgsqlDatabase.RunInTransaction
 func (d *CrdbDatabase) RunInTransaction(ctx context.Context, fn dbconnector.TransactionFN) error {
+	// join the ambient transaction
+	if tx, ok := dbconnector.AmbientTransaction(ctx, d.TenantConfig().TenantID()); ok {
+		return fn(ctx, tx)
+	}
+
 	errorConverter := pgsql_connector.NewCannotCommitTxErrorConverter(d.TenantConfig().TenantID())
 
-	err := crdbpgx.ExecuteTx(ctx, d.PgxConn(), pgx.TxOptions{}, func(tx pgx.Tx) error {
+	attempt := 0
+	err := crdbpgx.ExecuteTx(ctx, txBeginner{database: d}, d.txOptions(ctx), func(tx pgx.Tx) error {
+
+		// statements are traced with the attempt they run in
+		attempt++
+		ctx := dbconnector.WithAttempt(ctx, attempt)
+		if attempt > 1 {
+			d.Logger().Warn("transaction retried", "attempt", attempt)
+		}
 
 		dbTx := d.CreateTx(tx)
 
-		txErr := fn(ctx, dbTx)
+		// every attempt restarts from the savepoint, which drops local variables
+		if err := d.SetLocalVariables(ctx, tx); err != nil {
+			return err
+		}
+
+		txErr := fn(dbconnector.WithTransaction(ctx, dbTx), dbTx)
 
 		return txErr
 
@@ -87,3 +158,16 @@ func (d *CrdbDatabase) RunInTransaction(ctx context.Context, fn dbconnector.Tran
 
 	return errorConverter.ConvertError(err)
 }
+
+// txBeginner begins the transactions of ExecuteTx with the traced PgsqlDatabase.BeginTx.
+type txBeginner struct {
+	database *CrdbDatabase
+}
+
+func (b txBeginner) Begin(ctx context.Context) (pgx.Tx, error) {
+	return b.database.BeginTx(ctx, pgx.TxOptions{})
+}
+
+func (b txBeginner) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	return b.database.BeginTx(ctx, txOptions)
+}
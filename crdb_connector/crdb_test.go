@@ -27,6 +27,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/fkmatsuda/dbconnector"
 	"github.com/fkmatsuda/errorex"
@@ -235,6 +236,32 @@ func TestCRDBConnector(t *testing.T) {
 
 	})
 
+	t.Run("Test stale reads", func(t *testing.T) {
+		conn, err := connector.Connect(context.Background(), "crdbtest")
+		assert.NoError(t, err)
+		defer conn.Close(context.Background())
+
+		var one int
+		followerCtx := dbconnector.WithStaleRead(context.Background(), dbconnector.StaleRead{})
+		assert.NoError(t, conn.QueryRow(followerCtx, "select 1").Scan(&one))
+
+		staleCtx := dbconnector.WithStaleRead(context.Background(), dbconnector.StaleRead{Staleness: 10 * time.Second})
+		var readAt time.Time
+		assert.NoError(t, conn.QueryRow(staleCtx, "select now()").Scan(&readAt))
+		assert.True(t, readAt.Before(time.Now().Add(-9*time.Second)))
+
+		rows, err := conn.Query(staleCtx, "select now()")
+		assert.NoError(t, err)
+		assert.True(t, rows.Next())
+		assert.NoError(t, rows.Close())
+
+		err = conn.RunInTransaction(staleCtx, func(ctx context.Context, tx dbconnector.Transaction) error {
+			_, err := tx.Exec(ctx, "insert into test_table (id, name) values ($1, $2)", 4, "test 4")
+			return err
+		})
+		assert.Error(t, err)
+	})
+
 	// Cleanup
 	database, err := connector.Connect(context.Background(), "crdbtest")
 	assert.NoError(t, err)
@@ -0,0 +1,162 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package crdb_connector
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/fkmatsuda/dbconnector"
+	"github.com/fkmatsuda/dbconnector/pgsql_connector"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/jackc/pgx/v5"
+)
+
+// asOfSystemTime returns the AS OF SYSTEM TIME expression of the stale reads allowed by ctx.
+func asOfSystemTime(ctx context.Context) (string, bool) {
+	staleRead, ok := dbconnector.StaleReadFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	if staleRead.Staleness <= 0 {
+		return "follower_read_timestamp()", true
+	}
+	return "'-" + strconv.FormatFloat(staleRead.Staleness.Seconds(), 'f', -1, 64) + "s'", true
+}
+
+// txOptions begins the transactions as of the system time of the stale reads allowed by ctx.
+func (d *CrdbDatabase) txOptions(ctx context.Context) pgx.TxOptions {
+	txOptions := d.TxOptions(ctx)
+	if aost, ok := asOfSystemTime(ctx); ok {
+		txOptions.AccessMode = pgx.ReadOnly
+		txOptions.BeginQuery = "begin transaction as of system time " + aost
+	}
+	return txOptions
+}
+
+// beginStaleRead begins the transaction of a stale read as of its system time, with the session
+// variables of the tenant set as in RunInTransaction. A stale read cannot join the ambient
+// transaction of ctx (see dbconnector.WithTransaction), which reads the present: it is refused.
+func (d *CrdbDatabase) beginStaleRead(ctx context.Context) (pgx.Tx, error) {
+	tenantID := d.TenantConfig().TenantID()
+	if _, ok := dbconnector.AmbientTransaction(ctx, tenantID); ok {
+		return nil, errorex.New(dbconnector.ErrCodeNotSupported, dbconnector.TenantErrorDetail{TenantID: tenantID})
+	}
+	tx, err := d.BeginTx(ctx, d.txOptions(ctx))
+	if err != nil {
+		return nil, d.beginFailed(err)
+	}
+	if err := d.SetLocalVariables(ctx, tx); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return tx, nil
+}
+
+// override PgsqlDatabase.Query
+func (d *CrdbDatabase) Query(ctx context.Context, query string, args ...interface{}) (dbconnector.Rows, error) {
+	if _, ok := asOfSystemTime(ctx); !ok {
+		return d.PgsqlDatabase.Query(ctx, query, args...)
+	}
+	// the stale read needs a transaction as of its system time
+	tx, err := d.beginStaleRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.CreateTx(tx).Query(ctx, query, args...)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return &staleRows{Rows: rows, ctx: ctx, tx: tx, tenantID: d.TenantConfig().TenantID()}, nil
+}
+
+// override PgsqlDatabase.QueryRow
+func (d *CrdbDatabase) QueryRow(ctx context.Context, query string, args ...interface{}) dbconnector.Row {
+	if _, ok := asOfSystemTime(ctx); !ok {
+		return d.PgsqlDatabase.QueryRow(ctx, query, args...)
+	}
+	tx, err := d.beginStaleRead(ctx)
+	if err != nil {
+		return &errorRow{err: err}
+	}
+	return &staleRow{Row: d.CreateTx(tx).QueryRow(ctx, query, args...), ctx: ctx, tx: tx}
+}
+
+func (d *CrdbDatabase) beginFailed(err error) error {
+	return pgsql_connector.NewGenericDbErrorConverter(d.TenantConfig().TenantID()).ConvertError(err)
+}
+
+// staleRows ends the transaction of a stale read once its rows are closed.
+type staleRows struct {
+	dbconnector.Rows
+	ctx      context.Context
+	tx       pgx.Tx
+	tenantID string
+}
+
+func (r *staleRows) Close() error {
+	err := r.Rows.Close()
+	// nothing was written, the transaction only ends
+	_ = r.tx.Rollback(r.ctx)
+	return err
+}
+
+// Columns implements dbconnector.ValueRows.
+func (r *staleRows) Columns() []string {
+	if valueRows, ok := r.Rows.(dbconnector.ValueRows); ok {
+		return valueRows.Columns()
+	}
+	return nil
+}
+
+// Values implements dbconnector.ValueRows.
+func (r *staleRows) Values() ([]interface{}, error) {
+	if valueRows, ok := r.Rows.(dbconnector.ValueRows); ok {
+		return valueRows.Values()
+	}
+	return nil, errorex.New(dbconnector.ErrCodeNotSupported, dbconnector.TenantErrorDetail{TenantID: r.tenantID})
+}
+
+// staleRow ends the transaction of a stale read once its row is scanned.
+type staleRow struct {
+	dbconnector.Row
+	ctx context.Context
+	tx  pgx.Tx
+}
+
+func (r *staleRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	_ = r.tx.Rollback(r.ctx)
+	return err
+}
+
+type errorRow struct {
+	err error
+}
+
+func (r *errorRow) Scan(dest ...interface{}) error {
+	return r.err
+}
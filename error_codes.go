@@ -28,15 +28,25 @@ import "github.com/fkmatsuda/errorex"
 const (
 	ModuleCode = "dbconnector"
 
-	ErrCodeConnectionFailed = ModuleCode + ".002"
-	ErrCodeTenantNotFound   = ModuleCode + ".003"
-	ErrCodeCannotBeginTx    = ModuleCode + ".005"
-	ErrCodeCannotCommitTx   = ModuleCode + ".006"
-	ErrCodeCannotRollbackTx = ModuleCode + ".007"
-	ErrCodeNotSupported     = ModuleCode + ".008"
-	ErrCodeQueryFailed      = ModuleCode + ".009"
-	ErrCodeCloseFailed      = ModuleCode + ".010"
-	ErrCodeGenericDBError   = ModuleCode + ".011"
+	ErrCodeConnectionFailed  = ModuleCode + ".002"
+	ErrCodeTenantNotFound    = ModuleCode + ".003"
+	ErrCodeCannotBeginTx     = ModuleCode + ".005"
+	ErrCodeCannotCommitTx    = ModuleCode + ".006"
+	ErrCodeCannotRollbackTx  = ModuleCode + ".007"
+	ErrCodeNotSupported      = ModuleCode + ".008"
+	ErrCodeQueryFailed       = ModuleCode + ".009"
+	ErrCodeCloseFailed       = ModuleCode + ".010"
+	ErrCodeGenericDBError    = ModuleCode + ".011"
+	ErrCodeInvalidQueryArgs  = ModuleCode + ".012"
+	ErrCodeUnknownStatement  = ModuleCode + ".013"
+	ErrCodeMissingTenant     = ModuleCode + ".014"
+	ErrCodeTenantSuspended   = ModuleCode + ".015"
+	ErrCodeTenantReadOnly    = ModuleCode + ".016"
+	ErrCodeInvalidMigration  = ModuleCode + ".017"
+	ErrCodeMigrationFailed   = ModuleCode + ".018"
+	ErrCodeMigrationChecksum = ModuleCode + ".019"
+	ErrCodeProvisionFailed   = ModuleCode + ".020"
+	ErrCodeAcquireTimeout    = ModuleCode + ".021"
 )
 
 func init() {
@@ -49,6 +59,27 @@ func init() {
 	errorex.RegisterErrorCode(ErrCodeQueryFailed, "query failed", QueryErrorDetail{})
 	errorex.RegisterErrorCode(ErrCodeCloseFailed, "close failed", DatabaseErrorDetail{})
 	errorex.RegisterErrorCode(ErrCodeGenericDBError, "generic database error", DatabaseErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeInvalidQueryArgs, "invalid query arguments", QueryErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeUnknownStatement, "unknown statement", StatementErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeMissingTenant, "missing tenant in context", TenantErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeTenantSuspended, "tenant suspended", TenantErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeTenantReadOnly, "tenant is read-only", TenantErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeInvalidMigration, "invalid migration", MigrationErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeMigrationFailed, "migration failed", MigrationErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeMigrationChecksum, "migration checksum mismatch", MigrationErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeProvisionFailed, "provisioning failed", ProvisionErrorDetail{})
+	errorex.RegisterErrorCode(ErrCodeAcquireTimeout, "connection acquire timed out", BudgetErrorDetail{})
+}
+
+// AsEX returns err as an errorex.EX, an error that is not one is wrapped in ErrCodeGenericDBError.
+func AsEX(tenantID string, err error) errorex.EX {
+	if ex, ok := err.(errorex.EX); ok {
+		return ex
+	}
+	return errorex.New(ErrCodeGenericDBError, DatabaseErrorDetail{
+		TenantErrorDetail: TenantErrorDetail{TenantID: tenantID},
+		DatabaseError:     err.Error(),
+	})
 }
 
 // TenantErrorDetail is a struct that contains the details of an error returned by TenantError.
@@ -70,6 +101,36 @@ type QueryErrorDetail struct {
 	QueryArgs   []interface{} `json:"args"`
 }
 
+// StatementErrorDetail is a struct that contains the details of an error returned by a registered statement.
+type StatementErrorDetail struct {
+	TenantErrorDetail
+	StatementName string `json:"statementName"`
+}
+
+// MigrationErrorDetail is a struct that contains the details of an error returned by a migration.
+type MigrationErrorDetail struct {
+	TenantErrorDetail
+	Version int64      `json:"version"`
+	Name    string     `json:"name"`
+	Reason  string     `json:"reason,omitempty"`
+	Cause   errorex.EX `json:"cause,omitempty"`
+}
+
+// ProvisionErrorDetail is a struct that contains the details of an error returned by the provisioning of a tenant.
+type ProvisionErrorDetail struct {
+	TenantErrorDetail
+	Step  string     `json:"step"`
+	Cause errorex.EX `json:"cause,omitempty"`
+}
+
+// BudgetErrorDetail is a struct that contains the details of an error returned by a connection budget.
+type BudgetErrorDetail struct {
+	TenantErrorDetail
+	Server         string `json:"server"`
+	MaxServerConns int    `json:"maxServerConns"`
+	Waited         string `json:"waited"`
+}
+
 // RollbackErrorDetail is a struct that contains the details of an error returned by RollbackError.
 type RollbackErrorDetail struct {
 	DatabaseError errorex.EX `json:"databaseError"`
@@ -0,0 +1,172 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+// DefaultForEachConcurrency is the number of tenants run at once by ForEachTenant.
+const DefaultForEachConcurrency = 4
+
+// TenantFunc is the function run against the database of each tenant by ForEachTenant.
+// Its context carries the tenant ID.
+type TenantFunc func(ctx context.Context, database Database) error
+
+// ForEachOptions configures ForEachTenant.
+type ForEachOptions struct {
+	// Concurrency is the number of tenants run at once, DefaultForEachConcurrency when zero.
+	Concurrency int
+	// Timeout bounds the connection and the function of each tenant, no timeout when zero.
+	Timeout time.Duration
+	// Selector restricts the tenants to those whose labels satisfy it, all tenants when empty.
+	Selector LabelSelector
+	// FailFast stops at the first failure: the running tenants are canceled and, as the
+	// remaining ones, skipped. Otherwise every tenant is run and the failures collected.
+	FailFast bool
+}
+
+// TenantFailure is the error of a tenant in ForEachTenant.
+type TenantFailure struct {
+	TenantID string
+	Err      errorex.EX
+}
+
+// ForEachResult is the outcome of ForEachTenant, sorted by tenant ID.
+type ForEachResult struct {
+	// Succeeded lists the tenants whose function returned nil.
+	Succeeded []string
+	// Failed lists the tenants that could not be connected or whose function failed.
+	Failed []TenantFailure
+	// Skipped lists the tenants not run, or canceled, after a failure in fail-fast mode.
+	Skipped []string
+	// err kept every tenant from running
+	err error
+}
+
+// Err returns the error that kept the tenants from running, such as a connector that does
+// not list its tenants, or else the error of the first failed tenant, or nil.
+func (r *ForEachResult) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	return r.Failed[0].Err
+}
+
+// ForEachTenant runs fn against the database of each current tenant of the connector, with
+// bounded concurrency, and reports the tenants that succeeded and those that failed. The
+// tenants are those listed by the connector (see TenantLister); a connector that does not
+// list them runs none and the result has an ErrCodeNotSupported error.
+func ForEachTenant(ctx context.Context, connector Connector, opts ForEachOptions, fn TenantFunc) *ForEachResult {
+	if _, ok := connector.(TenantLister); !ok {
+		return &ForEachResult{err: errorex.New(ErrCodeNotSupported, TenantErrorDetail{})}
+	}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = DefaultForEachConcurrency
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := &ForEachResult{}
+	var mu sync.Mutex
+	fail := func(tenantID string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if opts.FailFast && ctx.Err() == nil && runCtx.Err() != nil {
+			// canceled by the failure of another tenant
+			result.Skipped = append(result.Skipped, tenantID)
+			return
+		}
+		result.Failed = append(result.Failed, TenantFailure{TenantID: tenantID, Err: AsEX(tenantID, err)})
+		if opts.FailFast {
+			cancel()
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, tenant := range FindTenants(connector, opts.Selector) {
+		tenantID := tenant.TenantID()
+		sem <- struct{}{}
+		if ctx.Err() == nil && runCtx.Err() != nil {
+			// fail-fast
+			<-sem
+			mu.Lock()
+			result.Skipped = append(result.Skipped, tenantID)
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := runTenant(runCtx, connector, tenantID, opts.Timeout, fn); err != nil {
+				fail(tenantID, err)
+				return
+			}
+			mu.Lock()
+			result.Succeeded = append(result.Succeeded, tenantID)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(result.Succeeded)
+	sort.Strings(result.Skipped)
+	sort.Slice(result.Failed, func(i, j int) bool {
+		return result.Failed[i].TenantID < result.Failed[j].TenantID
+	})
+	return result
+}
+
+func runTenant(ctx context.Context, connector Connector, tenantID string, timeout time.Duration, fn TenantFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx = WithTenant(ctx, tenantID)
+
+	database, err := connector.Connect(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	// the tenant context may be done already
+	defer database.Close(context.WithoutCancel(ctx))
+	return fn(ctx, database)
+}
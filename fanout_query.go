@@ -0,0 +1,422 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"cmp"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+// TenantQueryOptions configures QueryTenants.
+type TenantQueryOptions struct {
+	ForEachOptions
+	// Less orders the merged rows by their values when set, see OrderByColumn.
+	// The rows are then sorted once every tenant answered instead of streamed.
+	Less func(a, b []interface{}) bool
+	// Limit caps the number of merged rows, no limit when zero. Each tenant contributes
+	// at most Limit rows, so with Less its query must return them in the same order.
+	Limit int
+}
+
+type tenantRow struct {
+	tenantID string
+	columns  []string
+	values   []interface{}
+}
+
+// TenantRows is the merged result of QueryTenants. It implements Rows, every row being
+// tagged with the ID of the tenant that returned it.
+type TenantRows struct {
+	rows    chan tenantRow
+	cancel  context.CancelFunc
+	stopped atomic.Bool
+	limit   int
+	count   int
+	current tenantRow
+	result  *ForEachResult
+	err     error
+}
+
+// QueryTenants runs a query on every tenant of the connector, each in a read-only transaction,
+// and merges the rows. Tenants are selected and run as in ForEachTenant; the failures are
+// reported by Err and Result once Next returns false. The rows of a tenant are held until its
+// transaction commits, so a failed tenant delivers no row and a retried one delivers its rows
+// once. TenantRows must be closed.
+func QueryTenants(ctx context.Context, connector Connector, opts TenantQueryOptions, query string, args ...interface{}) *TenantRows {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &TenantRows{
+		rows:   make(chan tenantRow, 64),
+		cancel: cancel,
+		limit:  opts.Limit,
+	}
+
+	ordered := opts.Less != nil
+	var mu sync.Mutex
+	var buffered []tenantRow
+	go func() {
+		result := ForEachTenant(ctx, connector, opts.ForEachOptions, func(ctx context.Context, database Database) error {
+			tenantID := database.TenantConfig().TenantID()
+			// the rows of the last attempt, a retried transaction starts over
+			var tenantRows []tenantRow
+			err := database.RunInTransaction(WithReadOnly(ctx), func(ctx context.Context, tx Transaction) error {
+				rows, err := tx.Query(ctx, query, args...)
+				if err != nil {
+					return err
+				}
+				defer rows.Close()
+				valueRows, ok := rows.(ValueRows)
+				if !ok {
+					return errorex.New(ErrCodeNotSupported, TenantErrorDetail{TenantID: tenantID})
+				}
+
+				tenantRows = nil
+				columns := valueRows.Columns()
+				for rows.Next() {
+					values, err := valueRows.Values()
+					if err != nil {
+						return err
+					}
+					tenantRows = append(tenantRows, tenantRow{tenantID: tenantID, columns: columns, values: values})
+					if opts.Limit > 0 && len(tenantRows) >= opts.Limit {
+						break
+					}
+				}
+				return rows.Err()
+			})
+			if err != nil && r.stopped.Load() {
+				// the rows were no longer wanted
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !ordered {
+				// the transaction committed, its rows are complete
+				for _, row := range tenantRows {
+					select {
+					case r.rows <- row:
+					case <-ctx.Done():
+						if r.stopped.Load() {
+							return nil
+						}
+						return ctx.Err()
+					}
+				}
+				return nil
+			}
+			mu.Lock()
+			buffered = append(buffered, tenantRows...)
+			mu.Unlock()
+			return nil
+		})
+
+		if ordered {
+			sort.SliceStable(buffered, func(i, j int) bool {
+				return opts.Less(buffered[i].values, buffered[j].values)
+			})
+			for _, row := range buffered {
+				select {
+				case r.rows <- row:
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+		}
+		r.result = result
+		close(r.rows)
+	}()
+	return r
+}
+
+// Next prepares the next row for reading.
+func (r *TenantRows) Next() bool {
+	if r.limit > 0 && r.count >= r.limit {
+		r.stop()
+		return false
+	}
+	row, ok := <-r.rows
+	if !ok {
+		if r.err == nil && !r.stopped.Load() {
+			r.err = r.result.Err()
+		}
+		return false
+	}
+	r.current = row
+	r.count++
+	return true
+}
+
+// TenantID returns the ID of the tenant of the current row.
+func (r *TenantRows) TenantID() string {
+	return r.current.tenantID
+}
+
+// Columns returns the names of the columns of the current row.
+func (r *TenantRows) Columns() []string {
+	return r.current.columns
+}
+
+// Values returns the values of the current row.
+func (r *TenantRows) Values() ([]interface{}, error) {
+	return r.current.values, nil
+}
+
+// Scan copies the values of the current row into dest, converting between numeric types
+// and from the driver.Valuer values such as pgtype.Numeric, refusing the lossy conversions.
+func (r *TenantRows) Scan(dest ...interface{}) error {
+	if len(dest) != len(r.current.values) {
+		return fmt.Errorf("expected %d destinations, got %d", len(r.current.values), len(dest))
+	}
+	for i, value := range r.current.values {
+		if err := assignValue(dest[i], value); err != nil {
+			return fmt.Errorf("column %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Err returns the error of the first failed tenant, once Next returned false.
+func (r *TenantRows) Err() error {
+	return r.err
+}
+
+// Result returns the outcome of every tenant, once Next returned false or the rows were closed.
+func (r *TenantRows) Result() *ForEachResult {
+	return r.result
+}
+
+// Close stops the queries still running.
+func (r *TenantRows) Close() error {
+	r.stop()
+	return nil
+}
+
+// stop cancels the queries and waits for them.
+func (r *TenantRows) stop() {
+	if r.stopped.Swap(true) {
+		return
+	}
+	r.cancel()
+	for range r.rows {
+	}
+}
+
+func assignValue(dest interface{}, value interface{}) error {
+	if d, ok := dest.(*interface{}); ok {
+		*d = value
+		return nil
+	}
+	destValue := reflect.ValueOf(dest)
+	if destValue.Kind() != reflect.Pointer || destValue.IsNil() {
+		return errors.New("destination must be a non-nil pointer")
+	}
+	target := destValue.Elem()
+	if valuer, ok := value.(driver.Valuer); ok && !acceptsValue(target.Type(), value) {
+		// e.g. the pgtype.Numeric of numeric columns, whose value is its text
+		driverValue, err := valuer.Value()
+		if err != nil {
+			return err
+		}
+		if text, ok := driverValue.(string); ok {
+			return assignValue(dest, numericText(text))
+		}
+		return assignValue(dest, driverValue)
+	}
+	if value == nil {
+		switch target.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			target.Set(reflect.Zero(target.Type()))
+			return nil
+		}
+		return fmt.Errorf("cannot scan NULL into %s", target.Type())
+	}
+	if target.Kind() == reflect.Pointer {
+		elem := reflect.New(target.Type().Elem())
+		if err := assignValue(elem.Interface(), value); err != nil {
+			return err
+		}
+		target.Set(elem)
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch text, isText := value.(numericText); {
+	case isText && isNumber(target.Kind()):
+		return assignNumericText(target, string(text))
+	case v.Type().AssignableTo(target.Type()):
+		target.Set(v)
+	case isNumber(v.Kind()) && isNumber(target.Kind()):
+		return assignNumber(target, v)
+	case v.Kind() == reflect.String && target.Kind() == reflect.String:
+		target.Set(v.Convert(target.Type()))
+	default:
+		return fmt.Errorf("cannot scan %T into %s", value, target.Type())
+	}
+	return nil
+}
+
+// numericText is the text a driver.Valuer returns for a value, which a number may be parsed from.
+type numericText string
+
+// acceptsValue reports whether a destination of type t, or the value t points to, takes the value as is.
+func acceptsValue(t reflect.Type, value interface{}) bool {
+	valueType := reflect.TypeOf(value)
+	return valueType.AssignableTo(t) || (t.Kind() == reflect.Pointer && valueType.AssignableTo(t.Elem()))
+}
+
+// assignNumericText sets the text of a numeric value into a number.
+func assignNumericText(target reflect.Value, text string) error {
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return assignNumber(target, reflect.ValueOf(i))
+	}
+	if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+		return assignNumber(target, reflect.ValueOf(u))
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("cannot scan %q into %s", text, target.Type())
+	}
+	return assignNumber(target, reflect.ValueOf(f))
+}
+
+// assignNumber sets a number into the target, refusing the values that do not fit its type
+// or would be truncated, like pgx does.
+func assignNumber(target, v reflect.Value) error {
+	fits := true
+	switch {
+	case isInt(v.Kind()):
+		i := v.Int()
+		switch {
+		case isInt(target.Kind()):
+			fits = !target.OverflowInt(i)
+		case isUint(target.Kind()):
+			fits = i >= 0 && !target.OverflowUint(uint64(i))
+		}
+	case isUint(v.Kind()):
+		u := v.Uint()
+		switch {
+		case isInt(target.Kind()):
+			fits = u <= math.MaxInt64 && !target.OverflowInt(int64(u))
+		case isUint(target.Kind()):
+			fits = !target.OverflowUint(u)
+		}
+	default:
+		f := v.Float()
+		switch {
+		case isInt(target.Kind()):
+			if f != math.Trunc(f) {
+				return fmt.Errorf("cannot scan %v into %s: not an integer", v, target.Type())
+			}
+			fits = f >= math.MinInt64 && f < math.MaxInt64 && !target.OverflowInt(int64(f))
+		case isUint(target.Kind()):
+			if f != math.Trunc(f) {
+				return fmt.Errorf("cannot scan %v into %s: not an integer", v, target.Type())
+			}
+			fits = f >= 0 && f < math.MaxUint64 && !target.OverflowUint(uint64(f))
+		default:
+			fits = !target.OverflowFloat(f)
+		}
+	}
+	if !fits {
+		return fmt.Errorf("cannot scan %v into %s: out of range", v, target.Type())
+	}
+	target.Set(v.Convert(target.Type()))
+	return nil
+}
+
+func isInt(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Int64
+}
+
+func isUint(kind reflect.Kind) bool {
+	return kind >= reflect.Uint && kind <= reflect.Uintptr
+}
+
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// OrderByColumn returns a Less function ordering the rows by the value of a column.
+// NULL sorts first; integers, floats, strings, booleans and times compare by value,
+// other types by their text.
+func OrderByColumn(index int, descending bool) func(a, b []interface{}) bool {
+	return func(a, b []interface{}) bool {
+		c := compareValues(a[index], b[index])
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	}
+}
+
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			return ta.Compare(tb)
+		}
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case isInt(va.Kind()) && isInt(vb.Kind()):
+		return cmp.Compare(va.Int(), vb.Int())
+	case isNumber(va.Kind()) && isNumber(vb.Kind()):
+		float64Type := reflect.TypeOf(float64(0))
+		return cmp.Compare(va.Convert(float64Type).Float(), vb.Convert(float64Type).Float())
+	case va.Kind() == reflect.Bool && vb.Kind() == reflect.Bool:
+		switch {
+		case va.Bool() == vb.Bool():
+			return 0
+		case !va.Bool():
+			return -1
+		}
+		return 1
+	case va.Kind() == reflect.String && vb.Kind() == reflect.String:
+		return strings.Compare(va.String(), vb.String())
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
@@ -0,0 +1,74 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultHealthTimeout bounds the check of each tenant when HealthOptions has no timeout.
+const DefaultHealthTimeout = 5 * time.Second
+
+// HealthChecker is implemented by connectors that check the databases of their tenants.
+type HealthChecker interface {
+	// HealthCheck checks the database of each current tenant.
+	HealthCheck(ctx context.Context, opts HealthOptions) *HealthReport
+}
+
+// HealthOptions configures HealthChecker.HealthCheck.
+type HealthOptions struct {
+	// Concurrency is the number of tenants checked at once, DefaultForEachConcurrency when zero.
+	Concurrency int
+	// Timeout bounds the check of each tenant, DefaultHealthTimeout when zero.
+	Timeout time.Duration
+	// Selector restricts the check to the tenants whose labels satisfy it, all tenants when empty.
+	Selector LabelSelector
+	// MaxUnreachable is the number of unreachable tenants tolerated by a healthy report,
+	// none when zero.
+	MaxUnreachable int
+}
+
+// TenantHealth is the health of the database of a tenant.
+type TenantHealth struct {
+	TenantID  string `json:"tenantId"`
+	Reachable bool   `json:"reachable"`
+	// Skipped reports a suspended tenant, which is not checked.
+	Skipped bool `json:"skipped,omitempty"`
+	// Latency is the round trip of a query, connection excluded.
+	Latency       time.Duration `json:"latencyNs"`
+	ServerVersion string        `json:"serverVersion,omitempty"`
+	// InRecovery reports a Postgres server in recovery, such as a hot standby.
+	InRecovery bool   `json:"inRecovery"`
+	ErrorCode  string `json:"errorCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HealthReport is the health of the tenants, sorted by tenant ID.
+type HealthReport struct {
+	// Healthy reports whether at most MaxUnreachable tenants are unreachable, the skipped
+	// tenants aside.
+	Healthy bool           `json:"healthy"`
+	Tenants []TenantHealth `json:"tenants"`
+}
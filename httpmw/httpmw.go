@@ -0,0 +1,129 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+// Package httpmw provides net/http middleware that resolves the tenant of a request
+// and hands its database to the handler through the request context.
+package httpmw
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+// ErrorHandler writes the response of a request whose tenant could not be resolved or connected.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// Option configures the middleware.
+type Option func(*middleware)
+
+// WithErrorHandler replaces the default error handler.
+func WithErrorHandler(errorHandler ErrorHandler) Option {
+	return func(m *middleware) {
+		m.errorHandler = errorHandler
+	}
+}
+
+type middleware struct {
+	connector    dbconnector.Connector
+	resolver     TenantResolver
+	errorHandler ErrorHandler
+}
+
+// New creates a middleware that resolves the tenant of each request, validates it against
+// the current tenants of the connector when it lists them (see dbconnector.TenantLister)
+// and connects to its database. The handler finds the
+// tenant and the database in the request context (see dbconnector.TenantFromContext and
+// dbconnector.DatabaseFromContext). The database is closed once the handler returns, even
+// if it panics.
+func New(connector dbconnector.Connector, resolver TenantResolver, opts ...Option) func(http.Handler) http.Handler {
+	m := &middleware{
+		connector:    connector,
+		resolver:     resolver,
+		errorHandler: DefaultErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.serveHTTP(w, r, next)
+		})
+	}
+}
+
+func (m *middleware) serveHTTP(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	tenantID, err := m.resolver(r)
+	if err != nil {
+		m.errorHandler(w, r, err)
+		return
+	}
+	if tenantID == "" {
+		m.errorHandler(w, r, errorex.New(dbconnector.ErrCodeMissingTenant, dbconnector.TenantErrorDetail{}))
+		return
+	}
+	if lister, ok := m.connector.(dbconnector.TenantLister); ok {
+		if _, ok := lister.Tenant(tenantID); !ok {
+			m.errorHandler(w, r, errorex.New(dbconnector.ErrCodeTenantNotFound, dbconnector.TenantErrorDetail{TenantID: tenantID}))
+			return
+		}
+	}
+
+	database, err := m.connector.Connect(r.Context(), tenantID)
+	if err != nil {
+		m.errorHandler(w, r, err)
+		return
+	}
+	defer func() {
+		// the request context may be done already
+		_ = database.Close(context.Background())
+	}()
+
+	next.ServeHTTP(w, r.WithContext(dbconnector.WithDatabase(r.Context(), database)))
+}
+
+// retryAfter is the Retry-After, in seconds, of the responses to a request that may succeed later.
+const retryAfter = "1"
+
+// DefaultErrorHandler maps the error code to the response status: 400 when the request
+// carries no tenant, 404 for an unknown tenant, 403 for a suspended tenant, 503 with a
+// Retry-After when the database is unreachable or its connection budget is exhausted,
+// and 500 otherwise.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errorex.Is(err, dbconnector.ErrCodeMissingTenant):
+		status = http.StatusBadRequest
+	case errorex.Is(err, dbconnector.ErrCodeTenantNotFound):
+		status = http.StatusNotFound
+	case errorex.Is(err, dbconnector.ErrCodeTenantSuspended):
+		status = http.StatusForbidden
+	case errorex.Is(err, dbconnector.ErrCodeConnectionFailed), errorex.Is(err, dbconnector.ErrCodeAcquireTimeout):
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,89 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package httpmw
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TenantResolver extracts the tenant ID from a request.
+// It returns an empty ID when the request carries no tenant.
+// Any func with this signature can be used as a custom resolver.
+type TenantResolver func(r *http.Request) (string, error)
+
+// Header resolves the tenant from a request header.
+func Header(name string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		return strings.TrimSpace(r.Header.Get(name)), nil
+	}
+}
+
+// Subdomain resolves the tenant from the host subdomain, e.g. "acme" for
+// "acme.example.com" with the base domain "example.com". Only a single label
+// in front of the base domain is accepted.
+func Subdomain(baseDomain string) TenantResolver {
+	suffix := "." + strings.ToLower(strings.Trim(baseDomain, "."))
+	return func(r *http.Request) (string, error) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		subdomain, ok := strings.CutSuffix(host, suffix)
+		if !ok || subdomain == "" || strings.Contains(subdomain, ".") {
+			return "", nil
+		}
+		return subdomain, nil
+	}
+}
+
+// PathPrefix resolves the tenant from the first segment of the request path, e.g. "acme" for "/acme/orders".
+func PathPrefix() TenantResolver {
+	return func(r *http.Request) (string, error) {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		return segment, nil
+	}
+}
+
+// QueryParam resolves the tenant from a query string parameter.
+func QueryParam(name string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		return r.URL.Query().Get(name), nil
+	}
+}
+
+// FirstOf tries the resolvers in order and returns the first tenant found.
+func FirstOf(resolvers ...TenantResolver) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		for _, resolver := range resolvers {
+			tenantID, err := resolver(r)
+			if err != nil || tenantID != "" {
+				return tenantID, err
+			}
+		}
+		return "", nil
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+// Package metrics exports the statistics of a connector in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fkmatsuda/dbconnector"
+)
+
+// ContentType is the media type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the statistics of the connector, for a Prometheus scrape.
+func Handler(connector dbconnector.Connector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = Write(w, connector)
+	})
+}
+
+// Write writes the statistics the connector reports (see dbconnector.PoolStatsReporter and
+// dbconnector.QueryStatsReporter).
+func Write(w io.Writer, connector dbconnector.Connector) error {
+	if reporter, ok := connector.(dbconnector.PoolStatsReporter); ok {
+		if err := WritePoolStats(w, reporter.Stats()); err != nil {
+			return err
+		}
+	}
+	if reporter, ok := connector.(dbconnector.QueryStatsReporter); ok {
+		return WriteQueryStats(w, reporter.QueryStats())
+	}
+	return nil
+}
+
+// poolMetric is a metric family taken from the pool statistics.
+type poolMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(dbconnector.PoolStats) float64
+}
+
+var poolMetrics = []poolMetric{
+	{"dbconnector_pool_acquired_connections", "gauge", "Connections acquired from the pool.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.AcquiredConns) }},
+	{"dbconnector_pool_idle_connections", "gauge", "Idle connections in the pool.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.IdleConns) }},
+	{"dbconnector_pool_connections", "gauge", "Open connections in the pool.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.TotalConns) }},
+	{"dbconnector_pool_max_connections", "gauge", "Maximum connections of the pool.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.MaxConns) }},
+	{"dbconnector_pool_acquires_total", "counter", "Connections acquired successfully.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.AcquireCount) }},
+	{"dbconnector_pool_waits_total", "counter", "Acquires that waited for a connection.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.WaitCount) }},
+	{"dbconnector_pool_wait_seconds_total", "counter", "Time spent acquiring connections.",
+		func(s dbconnector.PoolStats) float64 { return s.WaitDuration.Seconds() }},
+	{"dbconnector_pool_acquire_failures_total", "counter", "Connections that could not be acquired.",
+		func(s dbconnector.PoolStats) float64 { return float64(s.AcquireFailures) }},
+}
+
+// WritePoolStats writes the pool statistics, labelled by tenant, backend and role. A shared
+// pool is counted under one of its tenants only (see dbconnector.PoolStats), so the samples
+// can be summed across tenants.
+func WritePoolStats(w io.Writer, stats []dbconnector.PoolStats) error {
+	out := bufio.NewWriter(w)
+	for _, metric := range poolMetrics {
+		writeHeader(out, metric.name, metric.kind, metric.help)
+		for _, s := range stats {
+			writeSample(out, metric.name, metric.value(s), "tenant", s.TenantID, "backend", s.Backend, "role", s.Role)
+		}
+	}
+	return out.Flush()
+}
+
+// queryMetric is a metric family taken from the query statistics.
+type queryMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(dbconnector.QueryStats) float64
+}
+
+var queryMetrics = []queryMetric{
+	{"dbconnector_query_calls_total", "counter", "Runs of the statement.",
+		func(s dbconnector.QueryStats) float64 { return float64(s.Calls) }},
+	{"dbconnector_query_seconds_total", "counter", "Time spent running the statement.",
+		func(s dbconnector.QueryStats) float64 { return s.TotalTime.Seconds() }},
+	{"dbconnector_query_max_seconds", "gauge", "Longest run of the statement.",
+		func(s dbconnector.QueryStats) float64 { return s.MaxTime.Seconds() }},
+	{"dbconnector_query_rows_total", "counter", "Rows returned or affected by the statement.",
+		func(s dbconnector.QueryStats) float64 { return float64(s.Rows) }},
+	{"dbconnector_query_errors_total", "counter", "Runs of the statement that failed.",
+		func(s dbconnector.QueryStats) float64 { return float64(s.Errors) }},
+}
+
+// WriteQueryStats writes the query statistics, labelled by tenant, backend and fingerprint.
+// Nothing is written without statistics.
+func WriteQueryStats(w io.Writer, stats []dbconnector.QueryStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	out := bufio.NewWriter(w)
+	for _, metric := range queryMetrics {
+		writeHeader(out, metric.name, metric.kind, metric.help)
+		for _, s := range stats {
+			writeSample(out, metric.name, metric.value(s), "tenant", s.TenantID, "backend", s.Backend, "fingerprint", s.Fingerprint)
+		}
+	}
+	return out.Flush()
+}
+
+func writeHeader(out *bufio.Writer, name, kind, help string) {
+	out.WriteString("# HELP " + name + " " + help + "\n")
+	out.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// writeSample writes a sample with its labels, given as name and value pairs.
+func writeSample(out *bufio.Writer, name string, value float64, labels ...string) {
+	out.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			out.WriteString("{")
+		} else {
+			out.WriteString(",")
+		}
+		out.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	if len(labels) > 1 {
+		out.WriteString("}")
+	}
+	out.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
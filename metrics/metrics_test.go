@@ -0,0 +1,72 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+	"github.com/fkmatsuda/dbconnector/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePoolStats(t *testing.T) {
+	var out strings.Builder
+	err := metrics.WritePoolStats(&out, []dbconnector.PoolStats{
+		{TenantID: "acme", Backend: "pgsql", Role: dbconnector.PoolRolePrimary, AcquiredConns: 2, IdleConns: 3, TotalConns: 5, MaxConns: 10,
+			AcquireCount: 42, WaitCount: 4, WaitDuration: 1500 * time.Millisecond, AcquireFailures: 1},
+		{TenantID: `we"ird\`, Backend: "crdb", Role: dbconnector.PoolRoleReplica},
+	})
+	assert.NoError(t, err)
+	text := out.String()
+
+	assert.Contains(t, text, "# TYPE dbconnector_pool_acquired_connections gauge\n")
+	assert.Contains(t, text, "# TYPE dbconnector_pool_acquires_total counter\n")
+	assert.Contains(t, text, `dbconnector_pool_acquired_connections{tenant="acme",backend="pgsql",role="primary"} 2`+"\n")
+	assert.Contains(t, text, `dbconnector_pool_wait_seconds_total{tenant="acme",backend="pgsql",role="primary"} 1.5`+"\n")
+	assert.Contains(t, text, `dbconnector_pool_acquire_failures_total{tenant="acme",backend="pgsql",role="primary"} 1`+"\n")
+	assert.Contains(t, text, `dbconnector_pool_connections{tenant="we\"ird\\",backend="crdb",role="replica"} 0`+"\n")
+}
+
+func TestWriteQueryStats(t *testing.T) {
+	var out strings.Builder
+	assert.NoError(t, metrics.WriteQueryStats(&out, nil))
+	assert.Empty(t, out.String())
+
+	err := metrics.WriteQueryStats(&out, []dbconnector.QueryStats{
+		{TenantID: "acme", Backend: "pgsql", Fingerprint: "af63bd4c8601b7be", SQL: "select * from users where id = ?",
+			Calls: 3, TotalTime: 750 * time.Millisecond, MaxTime: 500 * time.Millisecond, Rows: 3, Errors: 1},
+	})
+	assert.NoError(t, err)
+	text := out.String()
+
+	assert.Contains(t, text, "# TYPE dbconnector_query_calls_total counter\n")
+	assert.Contains(t, text, `dbconnector_query_calls_total{tenant="acme",backend="pgsql",fingerprint="af63bd4c8601b7be"} 3`+"\n")
+	assert.Contains(t, text, `dbconnector_query_seconds_total{tenant="acme",backend="pgsql",fingerprint="af63bd4c8601b7be"} 0.75`+"\n")
+	assert.Contains(t, text, `dbconnector_query_max_seconds{tenant="acme",backend="pgsql",fingerprint="af63bd4c8601b7be"} 0.5`+"\n")
+	assert.Contains(t, text, `dbconnector_query_errors_total{tenant="acme",backend="pgsql",fingerprint="af63bd4c8601b7be"} 1`+"\n")
+}
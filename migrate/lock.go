@@ -0,0 +1,126 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultLeaseDuration is how long a lease row locks a tenant on CockroachDB.
+const DefaultLeaseDuration = 15 * time.Minute
+
+const leasePollInterval = time.Second
+
+// unlockFunc releases the lock of a tenant.
+type unlockFunc func() error
+
+// lock keeps other migrators away from the tenant until the returned function is called.
+// Postgres takes a session advisory lock, which CockroachDB does not implement, so
+// CockroachDB takes a lease row instead, which expires if the migrator dies.
+func (m *Migrator) lock(ctx context.Context, database dbconnector.Database) (unlockFunc, error) {
+	var version string
+	if err := database.QueryRow(ctx, "select version()").Scan(&version); err != nil {
+		return nil, err
+	}
+	if strings.Contains(version, "CockroachDB") {
+		return m.leaseLock(ctx, database)
+	}
+	return m.advisoryLock(ctx, database)
+}
+
+func (m *Migrator) advisoryLock(ctx context.Context, database dbconnector.Database) (unlockFunc, error) {
+	key := m.lockKey(database.TenantConfig().TenantID())
+	if _, err := dbconnector.Exec(ctx, database, "select pg_advisory_lock($1)", key); err != nil {
+		return nil, err
+	}
+	return func() error {
+		// the lock belongs to the session, release it even if ctx is done
+		_, err := dbconnector.Exec(context.WithoutCancel(ctx), database, "select pg_advisory_unlock($1)", key)
+		return err
+	}, nil
+}
+
+// lockKey identifies the history table of the tenant, tenants sharing a database
+// through their schemas do not wait for each other.
+func (m *Migrator) lockKey(tenantID string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("dbconnector/migrate/" + tenantID + "/" + m.table))
+	return int64(h.Sum64())
+}
+
+func (m *Migrator) leaseLock(ctx context.Context, database dbconnector.Database) (unlockFunc, error) {
+	table := m.lockTableIdentifier()
+	_, err := dbconnector.Exec(ctx, database, "create table if not exists "+table+` (
+		id int primary key,
+		owner text not null,
+		expires_at timestamptz not null
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerBytes := make([]byte, 16)
+	if _, err := rand.Read(ownerBytes); err != nil {
+		return nil, err
+	}
+	owner := hex.EncodeToString(ownerBytes)
+	acquireSQL := "insert into " + table + " (id, owner, expires_at) values (1, $1, now() + $2::int * interval '1 second')" +
+		" on conflict (id) do update set owner = excluded.owner, expires_at = excluded.expires_at" +
+		" where " + table + ".expires_at < now()"
+	for {
+		result, err := dbconnector.Exec(ctx, database, acquireSQL, owner, int(m.leaseDuration/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		if acquired, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if acquired > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+	return func() error {
+		_, err := dbconnector.Exec(context.WithoutCancel(ctx), database, "delete from "+table+" where id = 1 and owner = $1", owner)
+		return err
+	}, nil
+}
+
+func (m *Migrator) lockTableIdentifier() string {
+	parts := strings.Split(m.table, ".")
+	parts[len(parts)-1] += "_lock"
+	return pgx.Identifier(parts).Sanitize()
+}
@@ -0,0 +1,389 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+// Package migrate applies versioned schema migrations to the databases of the tenants.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultTable is the history table of the applied migrations.
+const DefaultTable = "schema_migrations"
+
+// DefaultConcurrency is the number of tenants migrated at once by MigrateAll.
+const DefaultConcurrency = 4
+
+// Latest is the target version of Migrate, past any migration.
+const Latest int64 = math.MaxInt64
+
+// Option configures a Migrator.
+type Option func(*Migrator)
+
+// WithTable sets the history table, optionally qualified by its schema.
+// An unqualified table lives in the schema of the tenant.
+func WithTable(table string) Option {
+	return func(m *Migrator) {
+		m.table = table
+	}
+}
+
+// WithConcurrency sets the number of tenants migrated at once by MigrateAll.
+func WithConcurrency(concurrency int) Option {
+	return func(m *Migrator) {
+		m.concurrency = concurrency
+	}
+}
+
+// WithDryRun writes the SQL that would be run on each tenant to w instead of running it.
+// A dry run only reads the history table and takes no lock.
+func WithDryRun(w io.Writer) Option {
+	return func(m *Migrator) {
+		m.dryRun = w
+	}
+}
+
+// WithoutLock disables the lock of the tenants, e.g. when the deploys are already serialized.
+func WithoutLock() Option {
+	return func(m *Migrator) {
+		m.noLock = true
+	}
+}
+
+// WithLeaseDuration sets how long a lease row locks a tenant on CockroachDB.
+// It must exceed the time taken to migrate a tenant.
+func WithLeaseDuration(leaseDuration time.Duration) Option {
+	return func(m *Migrator) {
+		m.leaseDuration = leaseDuration
+	}
+}
+
+// Migrator applies a set of migrations to tenant databases.
+type Migrator struct {
+	migrations    []Migration
+	table         string
+	concurrency   int
+	dryRun        io.Writer
+	dryRunMu      sync.Mutex
+	noLock        bool
+	leaseDuration time.Duration
+}
+
+// New creates a migrator with the migrations of fsys (see Load).
+func New(fsys fs.FS, opts ...Option) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{
+		migrations:    migrations,
+		table:         DefaultTable,
+		concurrency:   DefaultConcurrency,
+		leaseDuration: DefaultLeaseDuration,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.concurrency < 1 {
+		m.concurrency = 1
+	}
+	return m, nil
+}
+
+// Migrations returns the migrations, sorted by version.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Step is a migration applied or reverted on a tenant.
+type Step struct {
+	Migration
+	// Revert reports whether the migration was reverted by its down script.
+	Revert bool
+}
+
+// Migrate applies the pending migrations to the database and returns the applied ones.
+func (m *Migrator) Migrate(ctx context.Context, database dbconnector.Database) ([]Step, error) {
+	return m.MigrateTo(ctx, database, Latest)
+}
+
+// MigrateTo brings the database to the target version: the applied migrations above it are
+// reverted, newest first, then the pending ones up to it are applied, each step in its own
+// transaction. It stops at the first failure and returns the steps done so far.
+// Before running any step, the checksums of the applied migrations are verified against
+// the migration files.
+func (m *Migrator) MigrateTo(ctx context.Context, database dbconnector.Database, target int64) (steps []Step, err error) {
+	tenantID := database.TenantConfig().TenantID()
+	if m.dryRun == nil && !m.noLock {
+		unlock, err := m.lock(ctx, database)
+		if err != nil {
+			return nil, m.migrationFailed(tenantID, Migration{}, err)
+		}
+		defer func() {
+			if unlockErr := unlock(); unlockErr != nil && err == nil {
+				err = m.migrationFailed(tenantID, Migration{}, unlockErr)
+			}
+		}()
+	}
+
+	applied, err := m.history(ctx, database)
+	if err != nil {
+		return nil, m.migrationFailed(tenantID, Migration{}, err)
+	}
+	plan, err := m.plan(tenantID, applied, target)
+	if err != nil {
+		return nil, err
+	}
+	if m.dryRun != nil {
+		return plan, m.writeDryRun(tenantID, plan)
+	}
+
+	for _, step := range plan {
+		if err := m.run(ctx, database, step); err != nil {
+			return steps, m.migrationFailed(tenantID, step.Migration, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// plan lists the steps that bring a tenant with the applied checksums by version to the target.
+func (m *Migrator) plan(tenantID string, applied map[int64]string, target int64) ([]Step, error) {
+	known := make(map[int64]bool, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		if checksum, ok := applied[migration.Version]; ok && checksum != migration.Checksum() {
+			return nil, m.planError(dbconnector.ErrCodeMigrationChecksum, tenantID, migration, "the migration was edited after it was applied")
+		}
+	}
+	for version := range applied {
+		if !known[version] && version > target {
+			return nil, m.planError(dbconnector.ErrCodeInvalidMigration, tenantID, Migration{Version: version}, "unknown applied migration")
+		}
+	}
+
+	var plan []Step
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= target {
+			continue
+		}
+		if !migration.HasDown {
+			return nil, m.planError(dbconnector.ErrCodeInvalidMigration, tenantID, migration, "no down migration")
+		}
+		plan = append(plan, Step{Migration: migration, Revert: true})
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok && migration.Version <= target {
+			plan = append(plan, Step{Migration: migration})
+		}
+	}
+	return plan, nil
+}
+
+func (m *Migrator) planError(errCode, tenantID string, migration Migration, reason string) error {
+	return errorex.New(errCode, dbconnector.MigrationErrorDetail{
+		TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: tenantID},
+		Version:           migration.Version,
+		Name:              migration.Name,
+		Reason:            reason,
+	})
+}
+
+func (m *Migrator) run(ctx context.Context, database dbconnector.Database, step Step) error {
+	script := step.Up
+	if step.Revert {
+		script = step.Down
+	}
+	return database.RunInTransaction(ctx, func(ctx context.Context, tx dbconnector.Transaction) error {
+		if strings.TrimSpace(script) != "" {
+			if _, err := tx.Exec(ctx, script); err != nil {
+				return err
+			}
+		}
+		if step.Revert {
+			_, err := tx.Exec(ctx, "delete from "+m.tableIdentifier()+" where version = $1", step.Version)
+			return err
+		}
+		_, err := tx.Exec(ctx, "insert into "+m.tableIdentifier()+" (version, name, checksum) values ($1, $2, $3)",
+			step.Version, step.Name, step.Checksum())
+		return err
+	})
+}
+
+func (m *Migrator) writeDryRun(tenantID string, plan []Step) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- tenant %s: %d step(s)\n", tenantID, len(plan))
+	for _, step := range plan {
+		direction, script := "up", step.Up
+		if step.Revert {
+			direction, script = "down", step.Down
+		}
+		fmt.Fprintf(&buf, "-- %s %d %s\n%s\n", direction, step.Version, step.Name, strings.TrimSpace(script))
+	}
+
+	// tenants migrated at once do not interleave their output
+	m.dryRunMu.Lock()
+	defer m.dryRunMu.Unlock()
+	_, err := m.dryRun.Write(buf.Bytes())
+	return err
+}
+
+// history returns the checksums of the applied migrations by version.
+// The history table is created unless it is a dry run.
+func (m *Migrator) history(ctx context.Context, database dbconnector.Database) (map[int64]string, error) {
+	applied := make(map[int64]string)
+	if m.dryRun != nil {
+		exists, err := m.tableExists(ctx, database)
+		if err != nil || !exists {
+			return applied, err
+		}
+	} else if _, err := dbconnector.Exec(ctx, database, m.createTableSQL()); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.Query(ctx, "select version, checksum from "+m.tableIdentifier())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		var checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		applied[version] = checksum
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) tableExists(ctx context.Context, database dbconnector.Database) (bool, error) {
+	var schema interface{}
+	parts := strings.Split(m.table, ".")
+	if len(parts) > 1 {
+		schema = parts[len(parts)-2]
+	}
+	var count int
+	err := database.QueryRow(ctx, "select count(*) from information_schema.tables"+
+		" where table_schema = coalesce($1::text, current_schema()) and table_name = $2",
+		schema, parts[len(parts)-1]).Scan(&count)
+	return count > 0, err
+}
+
+func (m *Migrator) createTableSQL() string {
+	return "create table if not exists " + m.tableIdentifier() + ` (
+		version bigint primary key,
+		name text not null,
+		checksum text not null,
+		applied_at timestamptz not null default now()
+	)`
+}
+
+func (m *Migrator) tableIdentifier() string {
+	return pgx.Identifier(strings.Split(m.table, ".")).Sanitize()
+}
+
+func (m *Migrator) migrationFailed(tenantID string, migration Migration, err error) error {
+	return errorex.New(dbconnector.ErrCodeMigrationFailed, dbconnector.MigrationErrorDetail{
+		TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: tenantID},
+		Version:           migration.Version,
+		Name:              migration.Name,
+		Cause:             dbconnector.AsEX(tenantID, err),
+	})
+}
+
+// TenantReport is the outcome of the migration of a tenant.
+type TenantReport struct {
+	TenantID string
+	Steps    []Step
+	Err      error
+}
+
+// Report is the outcome of MigrateAll, sorted by tenant ID.
+type Report struct {
+	Tenants []TenantReport
+	// Err kept every tenant from being migrated, e.g. a connector that does not list its tenants.
+	Err error
+}
+
+// Failed returns the reports of the tenants whose migration failed.
+func (r *Report) Failed() []TenantReport {
+	var failed []TenantReport
+	for _, tenant := range r.Tenants {
+		if tenant.Err != nil {
+			failed = append(failed, tenant)
+		}
+	}
+	return failed
+}
+
+// MigrateAll applies the pending migrations to every tenant of the connector.
+func (m *Migrator) MigrateAll(ctx context.Context, connector dbconnector.Connector) *Report {
+	return m.MigrateAllTo(ctx, connector, Latest)
+}
+
+// MigrateAllTo brings every tenant of the connector to the target version, up to the configured
+// concurrency at once. A failure of one tenant does not stop the others.
+func (m *Migrator) MigrateAllTo(ctx context.Context, connector dbconnector.Connector, target int64) *Report {
+	var mu sync.Mutex
+	steps := make(map[string][]Step)
+	result := dbconnector.ForEachTenant(ctx, connector, dbconnector.ForEachOptions{Concurrency: m.concurrency},
+		func(ctx context.Context, database dbconnector.Database) error {
+			tenantSteps, err := m.MigrateTo(ctx, database, target)
+			mu.Lock()
+			steps[database.TenantConfig().TenantID()] = tenantSteps
+			mu.Unlock()
+			return err
+		})
+
+	report := &Report{}
+	if len(result.Succeeded) == 0 && len(result.Failed) == 0 {
+		report.Err = result.Err()
+	}
+	for _, tenantID := range result.Succeeded {
+		report.Tenants = append(report.Tenants, TenantReport{TenantID: tenantID, Steps: steps[tenantID]})
+	}
+	for _, failure := range result.Failed {
+		report.Tenants = append(report.Tenants, TenantReport{TenantID: failure.TenantID, Steps: steps[failure.TenantID], Err: failure.Err})
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		return report.Tenants[i].TenantID < report.Tenants[j].TenantID
+	})
+	return report
+}
@@ -0,0 +1,146 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+const (
+	upSuffix   = ".up.sql"
+	downSuffix = ".down.sql"
+)
+
+// Migration is a versioned schema change.
+type Migration struct {
+	// Version orders the migrations, it is unique.
+	Version int64
+	// Name describes the migration.
+	Name string
+	// Up is the SQL script that applies the migration.
+	Up string
+	// Down is the SQL script that reverts the migration, it is optional.
+	Down string
+	// HasDown reports whether the migration has a down script.
+	HasDown bool
+}
+
+// Checksum returns the SHA-256 of the up and down scripts, recorded in the history table,
+// so that editing either script of an applied migration is detected.
+func (m Migration) Checksum() string {
+	hash := sha256.New()
+	for _, script := range []string{m.Up, m.Down} {
+		// length-prefixed, moving text between the scripts changes the checksum
+		hash.Write([]byte(strconv.Itoa(len(script)) + ":" + script))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Load reads the migrations in the root directory of fsys, sorted by version.
+// Migration files are named <version>_<name>.up.sql, e.g. 0001_create_users.up.sql,
+// with an optional <version>_<name>.down.sql that reverts it; any other file is ignored.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, invalidMigration(".", err.Error())
+	}
+
+	files := make(map[string]string)
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		suffix := upSuffix
+		if strings.HasSuffix(fileName, downSuffix) {
+			suffix = downSuffix
+		}
+		if entry.IsDir() || !strings.HasSuffix(fileName, suffix) {
+			continue
+		}
+		version, name, err := parseFileName(fileName, suffix)
+		if err != nil {
+			return nil, err
+		}
+		key := strconv.FormatInt(version, 10) + suffix
+		if other, ok := files[key]; ok {
+			return nil, invalidMigration(fileName, "duplicate version of "+other)
+		}
+		files[key] = fileName
+
+		script, err := fs.ReadFile(fsys, fileName)
+		if err != nil {
+			return nil, invalidMigration(fileName, err.Error())
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version}
+			byVersion[version] = migration
+		}
+		if suffix == upSuffix {
+			migration.Name = name
+			migration.Up = string(script)
+		} else {
+			migration.Down = string(script)
+			migration.HasDown = true
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for version, migration := range byVersion {
+		if _, ok := files[strconv.FormatInt(version, 10)+upSuffix]; !ok {
+			return nil, invalidMigration(files[strconv.FormatInt(version, 10)+downSuffix], "down migration without up migration")
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// parseFileName splits <version>_<name><suffix> into its version and name.
+func parseFileName(fileName, suffix string) (int64, string, error) {
+	base := strings.TrimSuffix(fileName, suffix)
+	versionText, name, _ := strings.Cut(base, "_")
+	version, err := strconv.ParseInt(versionText, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, "", invalidMigration(fileName, "the version must be a positive integer")
+	}
+	return version, name, nil
+}
+
+func invalidMigration(name, reason string) error {
+	return errorex.New(dbconnector.ErrCodeInvalidMigration, dbconnector.MigrationErrorDetail{
+		Name:   name,
+		Reason: reason,
+	})
+}
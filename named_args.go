@@ -0,0 +1,107 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// NamedArgsBinder resolves the values of named query placeholders.
+// When a binder is passed as the only argument of Query, QueryRow or Exec,
+// the :name and @name placeholders of the query are bound from it.
+type NamedArgsBinder interface {
+	// NamedArg returns the value bound to the given name.
+	NamedArg(name string) (interface{}, bool)
+}
+
+// NamedArgs binds named query placeholders from a map.
+type NamedArgs map[string]interface{}
+
+// NamedArg implements NamedArgsBinder.
+func (a NamedArgs) NamedArg(name string) (interface{}, bool) {
+	value, ok := a[name]
+	return value, ok
+}
+
+// StructArgs binds named query placeholders from the exported fields of a struct (or a pointer to one).
+// The field name is taken from the `db` tag, falling back to a case-insensitive match of the field name.
+// Fields tagged with `db:"-"` are ignored and embedded structs are flattened.
+func StructArgs(v interface{}) NamedArgsBinder {
+	return &structArgs{value: reflect.Indirect(reflect.ValueOf(v))}
+}
+
+// structArgs is a NamedArgsBinder backed by a struct.
+type structArgs struct {
+	value reflect.Value
+}
+
+// NamedArg implements NamedArgsBinder.
+func (a *structArgs) NamedArg(name string) (interface{}, bool) {
+	if a.value.Kind() != reflect.Struct {
+		return nil, false
+	}
+	fields := structFields(a.value.Type())
+	index, ok := fields[name]
+	if !ok {
+		index, ok = fields[strings.ToLower(name)]
+	}
+	if !ok {
+		return nil, false
+	}
+	field, err := a.value.FieldByIndexErr(index)
+	if err != nil {
+		// nil embedded pointer
+		return nil, true
+	}
+	return field.Interface(), true
+}
+
+// structFieldsCache maps a struct type to its named fields.
+var structFieldsCache sync.Map
+
+// structFields returns the field indexes of a struct type by tag name and by lower-cased field name.
+func structFields(t reflect.Type) map[string][]int {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+	fields := make(map[string][]int)
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("db")
+		switch tag {
+		case "-":
+			continue
+		case "":
+			fields[strings.ToLower(field.Name)] = field.Index
+		default:
+			fields[tag] = field.Index
+		}
+	}
+	structFieldsCache.Store(t, fields)
+	return fields
+}
@@ -0,0 +1,115 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// batchExecutor is implemented by connections and transactions.
+type batchExecutor interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+// SendBatch sends the queries of a batch in one round trip, the results must be closed.
+func (p *PgsqlDatabase) SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults {
+	return p.sendBatch(ctx, p.PgxConn(), batch)
+}
+
+// CopyFrom copies rows into a table with the COPY protocol and returns the number of rows copied.
+func (p *PgsqlDatabase) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	return p.copyFrom(ctx, p.PgxConn(), table, columns, src)
+}
+
+// SendBatch sends the queries of a batch in one round trip, the results must be closed.
+func (p *PgsqlTransaction) SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults {
+	return p.database.sendBatch(ctx, p.tx, batch)
+}
+
+// CopyFrom copies rows into a table with the COPY protocol and returns the number of rows copied.
+func (p *PgsqlTransaction) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	return p.database.copyFrom(ctx, p.tx, table, columns, src)
+}
+
+func (p *PgsqlDatabase) sendBatch(ctx context.Context, executor batchExecutor, batch *pgx.Batch) pgx.BatchResults {
+	if !p.connector.instrumented() {
+		return executor.SendBatch(ctx, batch)
+	}
+	queries := make([]string, len(batch.QueuedQueries))
+	argCount := 0
+	for i, query := range batch.QueuedQueries {
+		queries[i] = query.SQL
+		argCount += len(query.Arguments)
+	}
+	ctx, end := p.startTrace(ctx, dbconnector.TraceBatch, strings.Join(queries, ";\n"), argCount)
+	return &tracedBatchResults{BatchResults: executor.SendBatch(ctx, batch), end: end}
+}
+
+func (p *PgsqlDatabase) copyFrom(ctx context.Context, executor batchExecutor, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	ctx, end := p.startTrace(ctx, dbconnector.TraceCopy, copySQL(table, columns), 0)
+	copied, err := executor.CopyFrom(ctx, table, columns, src)
+	end(copied, err)
+	return copied, err
+}
+
+// copySQL describes a copy for tracing.
+func copySQL(table pgx.Identifier, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return "copy " + table.Sanitize() + " (" + strings.Join(quoted, ", ") + ") from stdin"
+}
+
+// tracedBatchResults ends the trace of a batch once its results are closed.
+type tracedBatchResults struct {
+	pgx.BatchResults
+	end          endTrace
+	rowsAffected int64
+}
+
+func (r *tracedBatchResults) Exec() (pgconn.CommandTag, error) {
+	tag, err := r.BatchResults.Exec()
+	r.rowsAffected += tag.RowsAffected()
+	return tag, err
+}
+
+func (r *tracedBatchResults) Close() error {
+	err := r.BatchResults.Close()
+	if r.end != nil {
+		r.end(r.rowsAffected, err)
+		r.end = nil
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultAcquireTimeout bounds the wait for a connection under a connection budget.
+const DefaultAcquireTimeout = 30 * time.Second
+
+// ConnectionBudget shares the connections of a database server, identified by its host and
+// port, among the tenants whose databases it hosts. The connection settings of a tenant
+// override MinTenantConns and MaxTenantConns with their MinConns and MaxConns.
+// The budget caps the connections acquired at once only: the idle connections of the pools,
+// including those kept by MinConns, are closed when the server reaches MaxServerConns, but the
+// pools may open them again, so the max_connections of the server must leave room for them.
+type ConnectionBudget struct {
+	// MaxServerConns is the number of connections the tenants hold at once on a server, 0 for no limit.
+	// Idle connections of other pools are closed when the server reaches it.
+	MaxServerConns int
+	// MinTenantConns is the share of a tenant: once the budget is exhausted, the tenants holding
+	// fewer connections are served first.
+	MinTenantConns int
+	// MaxTenantConns is the number of connections a tenant holds at once, 0 for no limit.
+	MaxTenantConns int
+	// AcquireTimeout bounds the wait for a connection, DefaultAcquireTimeout when zero.
+	AcquireTimeout time.Duration
+}
+
+// WithConnectionBudget limits the connections of the tenants. The tenants waiting for a
+// connection are served in turns, so that a busy tenant cannot starve the others.
+func WithConnectionBudget(budget ConnectionBudget) Option {
+	return func(c *PgsqlConnector) {
+		if budget.AcquireTimeout <= 0 {
+			budget.AcquireTimeout = DefaultAcquireTimeout
+		}
+		c.budget = &connectionBudget{
+			ConnectionBudget: budget,
+			servers:          make(map[string]*serverBudget),
+			serverOf:         make(map[string]string),
+		}
+	}
+}
+
+// connectionBudget hands out the leases of the connections of each server.
+type connectionBudget struct {
+	ConnectionBudget
+	mu      sync.Mutex
+	servers map[string]*serverBudget
+	// serverOf caches the server of each database URL
+	serverOf map[string]string
+}
+
+// serverBudget is the budget of a server.
+type serverBudget struct {
+	leases       int
+	tenantLeases map[string]int
+	waiting      map[string][]*budgetWaiter
+	// turns holds the tenants with waiters, the next to serve first
+	turns []string
+}
+
+type budgetWaiter struct {
+	tenantID string
+	min, max int
+	ready    chan struct{}
+	granted  bool
+}
+
+// server returns the host and port of a database URL.
+func (b *connectionBudget) server(databaseURL string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.serverLocked(databaseURL)
+}
+
+func (b *connectionBudget) serverLocked(databaseURL string) string {
+	if server, ok := b.serverOf[databaseURL]; ok {
+		return server
+	}
+	server := databaseURL
+	if config, err := pgx.ParseConfig(databaseURL); err == nil {
+		server = net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	}
+	b.serverOf[databaseURL] = server
+	return server
+}
+
+// tenantLimits returns the share and the limit of a tenant.
+func (b *connectionBudget) tenantLimits(config dbconnector.TenantConfig) (int, int) {
+	settings := dbconnector.TenantMetadataOf(config).ConnectionSettings
+	min, max := b.MinTenantConns, b.MaxTenantConns
+	if settings.MinConns > 0 {
+		min = int(settings.MinConns)
+	}
+	if settings.MaxConns > 0 {
+		max = int(settings.MaxConns)
+	}
+	return min, max
+}
+
+// reserve waits for a lease of a connection to the server of databaseURL, the returned function
+// releases it once, however often it is called.
+func (b *connectionBudget) reserve(ctx context.Context, databaseURL string, config dbconnector.TenantConfig) (func(), error) {
+	tenantID := config.TenantID()
+	min, max := b.tenantLimits(config)
+
+	b.mu.Lock()
+	server, s := b.serverBudgetLocked(databaseURL)
+	release := b.releaseFunc(server, tenantID)
+	if len(s.turns) == 0 && b.grantable(s, tenantID, max) {
+		s.grant(tenantID)
+		b.mu.Unlock()
+		return release, nil
+	}
+	waiter := &budgetWaiter{tenantID: tenantID, min: min, max: max, ready: make(chan struct{})}
+	if len(s.waiting[tenantID]) == 0 {
+		s.turns = append(s.turns, tenantID)
+	}
+	s.waiting[tenantID] = append(s.waiting[tenantID], waiter)
+	b.dispatch(s)
+	b.mu.Unlock()
+
+	timer := time.NewTimer(b.AcquireTimeout)
+	defer timer.Stop()
+	start := time.Now()
+	select {
+	case <-waiter.ready:
+		return release, nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if waiter.granted {
+		// granted meanwhile, give it to the next waiter
+		s.release(tenantID)
+		b.dispatch(s)
+	} else {
+		s.dequeue(waiter)
+	}
+	if ctx.Err() == context.Canceled {
+		// the caller went away, the budget is not exhausted
+		return nil, ctx.Err()
+	}
+	return nil, errorex.New(dbconnector.ErrCodeAcquireTimeout, dbconnector.BudgetErrorDetail{
+		TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: tenantID},
+		Server:            server,
+		MaxServerConns:    b.MaxServerConns,
+		Waited:            time.Since(start).String(),
+	})
+}
+
+// tryReserve takes a lease of a connection to the server of databaseURL only when one is free
+// right away, for work that is skipped rather than queued.
+func (b *connectionBudget) tryReserve(databaseURL string, config dbconnector.TenantConfig) (func(), bool) {
+	tenantID := config.TenantID()
+	_, max := b.tenantLimits(config)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	server, s := b.serverBudgetLocked(databaseURL)
+	if len(s.turns) > 0 || !b.grantable(s, tenantID, max) {
+		return nil, false
+	}
+	s.grant(tenantID)
+	return b.releaseFunc(server, tenantID), true
+}
+
+// serverBudgetLocked returns the server of databaseURL and its budget. The budget must be locked.
+func (b *connectionBudget) serverBudgetLocked(databaseURL string) (string, *serverBudget) {
+	server := b.serverLocked(databaseURL)
+	s, ok := b.servers[server]
+	if !ok {
+		s = &serverBudget{tenantLeases: make(map[string]int), waiting: make(map[string][]*budgetWaiter)}
+		b.servers[server] = s
+	}
+	return server, s
+}
+
+// releaseFunc returns a function that releases a lease once, however often it is called.
+func (b *connectionBudget) releaseFunc(server, tenantID string) func() {
+	var once sync.Once
+	return func() { once.Do(func() { b.release(server, tenantID) }) }
+}
+
+func (b *connectionBudget) release(server, tenantID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.servers[server]
+	s.release(tenantID)
+	b.dispatch(s)
+}
+
+// grantable reports whether a tenant may take a lease now. The budget must be locked.
+func (b *connectionBudget) grantable(s *serverBudget, tenantID string, max int) bool {
+	return (b.MaxServerConns <= 0 || s.leases < b.MaxServerConns) && (max <= 0 || s.tenantLeases[tenantID] < max)
+}
+
+// dispatch grants leases to the waiters in turns, the tenants below their share first.
+// The budget must be locked.
+func (b *connectionBudget) dispatch(s *serverBudget) {
+	for {
+		turn := -1
+		for i, tenantID := range s.turns {
+			waiter := s.waiting[tenantID][0]
+			if !b.grantable(s, tenantID, waiter.max) {
+				continue
+			}
+			if s.tenantLeases[tenantID] < waiter.min {
+				turn = i
+				break
+			}
+			if turn < 0 {
+				turn = i
+			}
+		}
+		if turn < 0 {
+			return
+		}
+		tenantID := s.turns[turn]
+		waiter := s.waiting[tenantID][0]
+		s.waiting[tenantID] = s.waiting[tenantID][1:]
+		// the tenant goes to the end of the turns
+		s.turns = append(s.turns[:turn], s.turns[turn+1:]...)
+		if len(s.waiting[tenantID]) > 0 {
+			s.turns = append(s.turns, tenantID)
+		} else {
+			delete(s.waiting, tenantID)
+		}
+		s.grant(tenantID)
+		waiter.granted = true
+		close(waiter.ready)
+	}
+}
+
+func (s *serverBudget) grant(tenantID string) {
+	s.leases++
+	s.tenantLeases[tenantID]++
+}
+
+func (s *serverBudget) release(tenantID string) {
+	s.leases--
+	if s.tenantLeases[tenantID]--; s.tenantLeases[tenantID] <= 0 {
+		delete(s.tenantLeases, tenantID)
+	}
+}
+
+// dequeue drops a waiter that gave up.
+func (s *serverBudget) dequeue(waiter *budgetWaiter) {
+	queue := s.waiting[waiter.tenantID]
+	for i, w := range queue {
+		if w == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		s.waiting[waiter.tenantID] = queue
+		return
+	}
+	delete(s.waiting, waiter.tenantID)
+	for i, tenantID := range s.turns {
+		if tenantID == waiter.tenantID {
+			s.turns = append(s.turns[:i], s.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// evictIdle closes idle connections of the other pools of the server of databaseURL when the
+// server would exceed MaxServerConns, so that the idle connections of cold tenants do not
+// hold the connections a busy tenant needs.
+func (c *PgsqlConnector) evictIdle(ctx context.Context, databaseURL string) {
+	if c.budget.MaxServerConns <= 0 {
+		return
+	}
+	server := c.budget.server(databaseURL)
+	c.mu.RLock()
+	pool := c.pools[databaseURL]
+	if pool == nil || pool.Stat().IdleConns() > 0 {
+		// an idle connection of the pool is reused
+		c.mu.RUnlock()
+		return
+	}
+	total := 0
+	var others []*pgxpool.Pool
+	for otherURL, other := range c.pools {
+		if c.budget.server(otherURL) != server {
+			continue
+		}
+		total += int(other.Stat().TotalConns())
+		if other != pool {
+			others = append(others, other)
+		}
+	}
+	c.mu.RUnlock()
+
+	// room for the connection the pool opens
+	excess := total + 1 - c.budget.MaxServerConns
+	evicted := 0
+	for _, other := range others {
+		if evicted >= excess {
+			break
+		}
+		for _, conn := range other.AcquireAllIdle(ctx) {
+			if evicted < excess {
+				// the pool destroys closed connections on release
+				_ = conn.Conn().Close(ctx)
+				evicted++
+			}
+			conn.Release()
+		}
+	}
+	if evicted > 0 {
+		c.logger.Debug("idle connections evicted", "server", server, "connections", evicted)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+	"github.com/fkmatsuda/dbconnector/test"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionBudget(t *testing.T) {
+	acme := test.NewMockTenantConfig("acme", "Acme", "postgres://app@db1:5432/acme")
+	globex := test.NewMockTenantConfig("globex", "Globex", "postgres://app@db1/globex")
+	newBudget := func(budget ConnectionBudget) *connectionBudget {
+		c := &PgsqlConnector{}
+		WithConnectionBudget(budget)(c)
+		return c.budget
+	}
+	// reserveAsync reserves a lease in the background, the channel receives its release function
+	reserveAsync := func(budget *connectionBudget, config dbconnector.TenantConfig) chan func() {
+		granted := make(chan func(), 1)
+		go func() {
+			release, err := budget.reserve(context.Background(), config.DatabaseURL(), config)
+			if err == nil {
+				granted <- release
+			}
+		}()
+		// let the reservation queue up
+		time.Sleep(20 * time.Millisecond)
+		return granted
+	}
+
+	t.Run("Test shared by server", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 1})
+		assert.Equal(t, budget.server(acme.DatabaseURL()), budget.server(globex.DatabaseURL()))
+		release, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		granted := reserveAsync(budget, globex)
+		assert.Empty(t, granted)
+		release()
+		(<-granted)()
+	})
+
+	t.Run("Test served in turns", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 1})
+		release, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		acmeGranted := reserveAsync(budget, acme)
+		acmeGranted2 := reserveAsync(budget, acme)
+		globexGranted := reserveAsync(budget, globex)
+
+		release()
+		release = <-acmeGranted
+		release()
+		// globex takes its turn before the second acme waiter
+		release = <-globexGranted
+		assert.Empty(t, acmeGranted2)
+		release()
+		(<-acmeGranted2)()
+	})
+
+	t.Run("Test tenant limits", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 3, MinTenantConns: 1, MaxTenantConns: 2})
+		release1, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		release2, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		// acme is at its limit, globex gets the room left
+		acmeGranted := reserveAsync(budget, acme)
+		release3, err := budget.reserve(context.Background(), globex.DatabaseURL(), globex)
+		assert.NoError(t, err)
+		assert.Empty(t, acmeGranted)
+
+		// the acme waiter does not hold up globex
+		release3()
+		release3, err = budget.reserve(context.Background(), globex.DatabaseURL(), globex)
+		assert.NoError(t, err)
+		release1()
+		(<-acmeGranted)()
+		release2()
+		release3()
+	})
+
+	t.Run("Test released once", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 1})
+		release, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		release()
+		release()
+		release, err = budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		// the second release did not free a lease
+		granted := reserveAsync(budget, globex)
+		assert.Empty(t, granted)
+		release()
+		(<-granted)()
+	})
+
+	t.Run("Test try reserve", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 1})
+		release, ok := budget.tryReserve(acme.DatabaseURL(), acme)
+		assert.True(t, ok)
+		_, ok = budget.tryReserve(globex.DatabaseURL(), globex)
+		assert.False(t, ok)
+		release()
+		release()
+		release, ok = budget.tryReserve(globex.DatabaseURL(), globex)
+		assert.True(t, ok)
+		// the lease freed goes to the waiter
+		granted := reserveAsync(budget, acme)
+		release()
+		_, ok = budget.tryReserve(globex.DatabaseURL(), globex)
+		assert.False(t, ok)
+		(<-granted)()
+	})
+
+	t.Run("Test cancelled wait", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 1})
+		release, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err = budget.reserve(ctx, globex.DatabaseURL(), globex)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.False(t, errorex.Is(err, dbconnector.ErrCodeAcquireTimeout))
+		release()
+		release, err = budget.reserve(context.Background(), globex.DatabaseURL(), globex)
+		assert.NoError(t, err)
+		release()
+	})
+
+	t.Run("Test acquire timeout", func(t *testing.T) {
+		budget := newBudget(ConnectionBudget{MaxServerConns: 1, AcquireTimeout: 20 * time.Millisecond})
+		release, err := budget.reserve(context.Background(), acme.DatabaseURL(), acme)
+		assert.NoError(t, err)
+		_, err = budget.reserve(context.Background(), globex.DatabaseURL(), globex)
+		assert.True(t, errorex.Is(err, dbconnector.ErrCodeAcquireTimeout))
+		release()
+		release, err = budget.reserve(context.Background(), globex.DatabaseURL(), globex)
+		assert.NoError(t, err)
+		release()
+	})
+}
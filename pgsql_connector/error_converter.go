@@ -40,7 +40,11 @@ func (c *pgErrorConverter) ConvertError(err error) errorex.EX {
 	if detail, ok := pgErrorDetail(c, err); ok {
 		return errorex.New(c.errCode, detail)
 	}
-	return c.ConvertError(err)
+	// keep the errors already raised by the connector, e.g. a read-only tenant
+	if ex, ok := err.(errorex.EX); ok {
+		return ex
+	}
+	return c.BaseErrorConverter.ConvertError(err)
 }
 
 func pgErrorDetail(c *pgErrorConverter, err error) (dbconnector.DatabaseErrorDetail, bool) {
@@ -0,0 +1,58 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPgErrorConverter(t *testing.T) {
+	converter := newPGErrorConverter(dbconnector.ErrCodeGenericDBError, "acme")
+
+	t.Run("Test database error", func(t *testing.T) {
+		ex := converter.ConvertError(&pgconn.PgError{Code: "42P01", Message: "relation does not exist"})
+		assert.Equal(t, dbconnector.ErrCodeGenericDBError, ex.Code())
+		detail, ok := ex.Detail().(dbconnector.DatabaseErrorDetail)
+		assert.True(t, ok)
+		assert.Equal(t, "acme", detail.TenantID)
+		assert.Equal(t, "42P01", detail.DatabaseErrorCode)
+	})
+
+	t.Run("Test connector error is kept", func(t *testing.T) {
+		readOnly := errorex.New(dbconnector.ErrCodeTenantReadOnly, dbconnector.TenantErrorDetail{TenantID: "acme"})
+		assert.Equal(t, dbconnector.ErrCodeTenantReadOnly, converter.ConvertError(readOnly).Code())
+	})
+
+	t.Run("Test other error", func(t *testing.T) {
+		// it used to call itself again until the stack overflowed
+		assert.NotNil(t, converter.ConvertError(errors.New("connection reset")))
+	})
+}
@@ -0,0 +1,212 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Reasons of the eviction of a pool.
+const (
+	// EvictedIdle is the reason of a pool unused for the idle timeout.
+	EvictedIdle = "idle"
+	// EvictedMaxPools is the reason of the least recently used pool beyond the max live pools.
+	EvictedMaxPools = "max_pools"
+)
+
+// minEvictionPeriod is the shortest period between two checks of the idle pools.
+const minEvictionPeriod = time.Second
+
+// PoolEviction closes the pools of the cold tenants. A pool with acquired connections is never
+// evicted, and an evicted pool is created again on the next connection.
+type PoolEviction struct {
+	// IdleTimeout is how long a pool stays unused before it is closed, 0 to keep idle pools.
+	IdleTimeout time.Duration
+	// MaxLivePools is the number of pools kept open, 0 for no limit. The least recently used
+	// pools are closed beyond it.
+	MaxLivePools int
+}
+
+// PoolEvicted describes an evicted pool.
+type PoolEvicted struct {
+	// Database is the URL of the pool, without its password.
+	Database string
+	// TenantIDs are the tenants of the pool.
+	TenantIDs []string
+	// Reason is EvictedIdle or EvictedMaxPools.
+	Reason string
+	// Idle is how long the pool was unused.
+	Idle time.Duration
+}
+
+// PoolEvictionObserver receives the evicted pools.
+type PoolEvictionObserver func(evicted PoolEvicted)
+
+// WithPoolEviction closes the pools of the cold tenants.
+func WithPoolEviction(eviction PoolEviction) Option {
+	return func(c *PgsqlConnector) {
+		c.eviction = eviction
+	}
+}
+
+// WithPoolEvictionObserver adds an observer of the evicted pools.
+func WithPoolEvictionObserver(observer PoolEvictionObserver) Option {
+	return func(c *PgsqlConnector) {
+		c.evictionObservers = append(c.evictionObservers, observer)
+	}
+}
+
+// touch records a use of the pool of a database.
+func (c *PgsqlConnector) touch(databaseURL string) {
+	c.mu.RLock()
+	lastUsed, ok := c.lastUsed[databaseURL]
+	c.mu.RUnlock()
+	if ok {
+		lastUsed.Store(time.Now().UnixNano())
+	}
+}
+
+// monitorIdlePools evicts the pools unused for the idle timeout until ctx is done.
+func (c *PgsqlConnector) monitorIdlePools(ctx context.Context) {
+	// an idle pool lives at most half the timeout longer, checked at most once a second
+	ticker := time.NewTicker(max(c.eviction.IdleTimeout/2, minEvictionPeriod))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.evictPools(c.eviction.IdleTimeout, 0, "")
+		}
+	}
+}
+
+// evictPools closes the unused pools idle for idleTimeout or more, then the least recently used
+// ones while more than maxPools are open. Zero disables either criterion. The pool of keepURL,
+// which is about to be used, is kept.
+func (c *PgsqlConnector) evictPools(idleTimeout time.Duration, maxPools int, keepURL string) {
+	c.mu.Lock()
+	now := time.Now()
+	type candidate struct {
+		databaseURL string
+		idle        time.Duration
+	}
+	var candidates []candidate
+	for databaseURL, pool := range c.pools {
+		if databaseURL == keepURL || pool.Stat().AcquiredConns() > 0 {
+			continue
+		}
+		idle := now.Sub(time.Unix(0, c.lastUsed[databaseURL].Load()))
+		candidates = append(candidates, candidate{databaseURL: databaseURL, idle: idle})
+	}
+	// least recently used first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].idle > candidates[j].idle
+	})
+
+	var closed []*pgxpool.Pool
+	var evicted []PoolEvicted
+	for _, candidate := range candidates {
+		reason := ""
+		switch {
+		case idleTimeout > 0 && candidate.idle >= idleTimeout:
+			reason = EvictedIdle
+		case maxPools > 0 && len(c.pools) > maxPools:
+			reason = EvictedMaxPools
+		default:
+			continue
+		}
+		closed = append(closed, c.pools[candidate.databaseURL])
+		delete(c.pools, candidate.databaseURL)
+		delete(c.lastUsed, candidate.databaseURL)
+		evicted = append(evicted, PoolEvicted{
+			Database:  redactURL(candidate.databaseURL),
+			TenantIDs: c.poolTenants(candidate.databaseURL),
+			Reason:    reason,
+			Idle:      candidate.idle,
+		})
+	}
+	c.mu.Unlock()
+
+	for _, pool := range closed {
+		// Close waits for the connections acquired since, if any, to be released
+		go pool.Close()
+	}
+	for _, event := range evicted {
+		c.logger.Info("pool evicted", "database", event.Database, "tenants", event.TenantIDs, "reason", event.Reason, "idle", event.Idle)
+		for _, observer := range c.evictionObservers {
+			observer(event)
+		}
+	}
+}
+
+// livePool returns the pool of a database while it is open, without creating it.
+func (c *PgsqlConnector) livePool(databaseURL string) (*pgxpool.Pool, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, false
+	}
+	pool, ok := c.pools[databaseURL]
+	return pool, ok
+}
+
+// evicted reports whether the pool of a database was closed since it was taken.
+func (c *PgsqlConnector) evicted(databaseURL string, pool *pgxpool.Pool) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pools[databaseURL] != pool
+}
+
+// poolTenants returns the tenants that use the pool of a database. The connector must be locked.
+func (c *PgsqlConnector) poolTenants(databaseURL string) []string {
+	var tenantIDs []string
+	for _, config := range c.tenantsConfig {
+		if config.DatabaseURL() == databaseURL {
+			tenantIDs = append(tenantIDs, config.TenantID())
+			continue
+		}
+		for _, replicaURL := range dbconnector.TenantReplicaURLs(config) {
+			if replicaURL == databaseURL {
+				tenantIDs = append(tenantIDs, config.TenantID())
+				break
+			}
+		}
+	}
+	return tenantIDs
+}
+
+// newLastUsed returns the last use of a new pool.
+func newLastUsed() *atomic.Int64 {
+	lastUsed := &atomic.Int64{}
+	lastUsed.Store(time.Now().UnixNano())
+	return lastUsed
+}
@@ -0,0 +1,87 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+)
+
+// HealthCheck connects to each tenant and queries its server version and recovery state.
+// CockroachDB servers are never in recovery. Suspended tenants are reported as skipped.
+func (c *PgsqlConnector) HealthCheck(ctx context.Context, opts dbconnector.HealthOptions) *dbconnector.HealthReport {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = dbconnector.DefaultHealthTimeout
+	}
+
+	var mu sync.Mutex
+	var tenants []dbconnector.TenantHealth
+	result := c.ForEachTenant(ctx, dbconnector.ForEachOptions{
+		Concurrency: opts.Concurrency,
+		Timeout:     timeout,
+		Selector:    opts.Selector,
+	}, func(ctx context.Context, database dbconnector.Database) error {
+		health := dbconnector.TenantHealth{TenantID: database.TenantConfig().TenantID(), Reachable: true}
+		start := time.Now()
+		if err := database.QueryRow(ctx, "select version()").Scan(&health.ServerVersion); err != nil {
+			return err
+		}
+		health.Latency = time.Since(start)
+		if !strings.Contains(health.ServerVersion, "CockroachDB") {
+			if err := database.QueryRow(ctx, "select pg_is_in_recovery()").Scan(&health.InRecovery); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		tenants = append(tenants, health)
+		mu.Unlock()
+		return nil
+	})
+
+	report := &dbconnector.HealthReport{Tenants: tenants}
+	unreachable := 0
+	for _, failure := range result.Failed {
+		if failure.Err.Code() == dbconnector.ErrCodeTenantSuspended {
+			report.Tenants = append(report.Tenants, dbconnector.TenantHealth{TenantID: failure.TenantID, Skipped: true})
+			continue
+		}
+		unreachable++
+		report.Tenants = append(report.Tenants, dbconnector.TenantHealth{
+			TenantID:  failure.TenantID,
+			ErrorCode: failure.Err.Code(),
+			Error:     failure.Err.Error(),
+		})
+	}
+	report.Healthy = unreachable <= opts.MaxUnreachable
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		return report.Tenants[i].TenantID < report.Tenants[j].TenantID
+	})
+	return report
+}
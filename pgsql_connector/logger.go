@@ -0,0 +1,99 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"regexp"
+
+	"github.com/fkmatsuda/dbconnector"
+)
+
+// WithLogger logs the reloads, pools, connection failures, rollbacks, retries and slow queries
+// (see WithSlowQueryThreshold).
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *PgsqlConnector) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// Logger returns the logger of the connector, tagged with the tenant.
+func (p *PgsqlDatabase) Logger() *slog.Logger {
+	return p.connector.logger.With("tenant", p.TenantConfig().TenantID())
+}
+
+// discardHandler drops every record, it is the handler of the default logger.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var dsnPassword = regexp.MustCompile(`password=('(\\.|[^'])*'|\S*)`)
+
+// redactURL hides the password of a database URL or key/value connection string.
+func redactURL(databaseURL string) string {
+	if u, err := url.Parse(databaseURL); err == nil && u.Scheme != "" {
+		query := u.Query()
+		if query.Has("password") {
+			query.Set("password", "xxxxx")
+			u.RawQuery = query.Encode()
+		}
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(databaseURL, "password=xxxxx")
+}
+
+// logReload logs the tenants added, removed and moved to another database by a reload.
+func (c *PgsqlConnector) logReload(previous, current []dbconnector.TenantConfig) {
+	databaseURLs := make(map[string]string, len(previous))
+	for _, config := range previous {
+		databaseURLs[config.TenantID()] = config.DatabaseURL()
+	}
+	var added, changed []string
+	for _, config := range current {
+		databaseURL, ok := databaseURLs[config.TenantID()]
+		switch {
+		case !ok:
+			added = append(added, config.TenantID())
+		case databaseURL != config.DatabaseURL():
+			changed = append(changed, config.TenantID())
+		}
+		delete(databaseURLs, config.TenantID())
+	}
+	removed := make([]string, 0, len(databaseURLs))
+	for tenantID := range databaseURLs {
+		removed = append(removed, tenantID)
+	}
+	if len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+		c.logger.Debug("tenants reloaded", "tenants", len(current))
+		return
+	}
+	c.logger.Info("tenants reloaded", "tenants", len(current), "added", added, "removed", removed, "changed", changed)
+}
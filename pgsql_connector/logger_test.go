@@ -0,0 +1,59 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/fkmatsuda/dbconnector"
+	"github.com/fkmatsuda/dbconnector/test"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactURL(t *testing.T) {
+	assert.Equal(t, "postgres://app:xxxxx@db:5432/acme?sslmode=disable",
+		redactURL("postgres://app:s3cr3t@db:5432/acme?sslmode=disable"))
+	assert.Equal(t, "postgres://db:5432/acme?password=xxxxx&user=app",
+		redactURL("postgres://db:5432/acme?user=app&password=s3cr3t"))
+	assert.Equal(t, "host=db user=app password=xxxxx dbname=acme",
+		redactURL("host=db user=app password=s3cr3t dbname=acme"))
+	assert.Equal(t, "host=db password=xxxxx dbname=acme",
+		redactURL(`host=db password='s3 cr\'3t' dbname=acme`))
+}
+
+func TestLogReload(t *testing.T) {
+	var out bytes.Buffer
+	c := &PgsqlConnector{logger: slog.New(slog.NewTextHandler(&out, nil))}
+	c.logReload([]dbconnector.TenantConfig{
+		test.NewMockTenantConfig("acme", "Acme", "postgres://db1/acme"),
+		test.NewMockTenantConfig("globex", "Globex", "postgres://db1/globex"),
+	}, []dbconnector.TenantConfig{
+		test.NewMockTenantConfig("acme", "Acme", "postgres://db2/acme"),
+		test.NewMockTenantConfig("initech", "Initech", "postgres://db1/initech"),
+	})
+	assert.Contains(t, out.String(), `msg="tenants reloaded" tenants=2 added=[initech] removed=[globex] changed=[acme]`)
+}
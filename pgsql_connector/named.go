@@ -0,0 +1,179 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+// namedQueryCacheSize is the maximum number of rewritten queries kept by a connector.
+const namedQueryCacheSize = 1024
+
+// namedQuery is a query rewritten from named to positional placeholders.
+type namedQuery struct {
+	sql   string
+	names []string
+}
+
+// parseNamedQuery rewrites the :name and @name placeholders of a query to $n.
+// Repeated names share the same position. Type casts (::), literals, quoted
+// identifiers and comments are left untouched.
+func parseNamedQuery(query string) (*namedQuery, error) {
+	var sql strings.Builder
+	var names []string
+	positions := make(map[string]int)
+
+	for _, token := range scanSQL(query) {
+		switch token.kind {
+		case sqlPositionalParam:
+			return nil, fmt.Errorf("positional placeholder %s cannot be mixed with named arguments", token.text)
+		case sqlNamedParam:
+			name := token.text[1:]
+			position, ok := positions[name]
+			if !ok {
+				names = append(names, name)
+				position = len(names)
+				positions[name] = position
+			}
+			sql.WriteString("$" + strconv.Itoa(position))
+		default:
+			sql.WriteString(token.text)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("query has no named placeholders")
+	}
+	return &namedQuery{sql: sql.String(), names: names}, nil
+}
+
+// namedQueryCache is a bounded LRU of rewritten named queries by their original SQL.
+type namedQueryCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// namedQueryEntry is an element of the namedQueryCache order.
+type namedQueryEntry struct {
+	query  string
+	parsed *namedQuery
+}
+
+func newNamedQueryCache() *namedQueryCache {
+	return &namedQueryCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the rewritten query, parsing and caching it on first use.
+func (c *namedQueryCache) get(query string) (*namedQuery, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[query]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*namedQueryEntry).parsed, nil
+	}
+	c.mu.Unlock()
+
+	parsed, err := parseNamedQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[query]; ok {
+		// parsed meanwhile
+		c.order.MoveToFront(element)
+		return parsed, nil
+	}
+	c.entries[query] = c.order.PushFront(&namedQueryEntry{query: query, parsed: parsed})
+	if c.order.Len() > namedQueryCacheSize {
+		// queries built at runtime must not grow the cache forever
+		oldest := c.order.Remove(c.order.Back()).(*namedQueryEntry)
+		delete(c.entries, oldest.query)
+	}
+	return parsed, nil
+}
+
+// bindNamedArgs rewrites a query with named placeholders when its only argument is a NamedArgsBinder.
+// Any other argument list is returned unchanged.
+func (p *PgsqlDatabase) bindNamedArgs(query string, args []interface{}) (string, []interface{}, error) {
+	binder, ok := namedArgsBinder(args)
+	if !ok {
+		return query, args, nil
+	}
+
+	invalidArgs := func(err error) error {
+		return errorex.New(dbconnector.ErrCodeInvalidQueryArgs,
+			dbconnector.QueryErrorDetail{
+				DatabaseErrorDetail: dbconnector.DatabaseErrorDetail{
+					TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
+					DatabaseError:     err.Error(),
+				},
+				QueryScript: query,
+				QueryArgs:   args,
+			},
+		)
+	}
+
+	parsed, err := p.connector.namedQueries.get(query)
+	if err != nil {
+		return "", nil, invalidArgs(err)
+	}
+	bound := make([]interface{}, len(parsed.names))
+	for i, name := range parsed.names {
+		value, ok := binder.NamedArg(name)
+		if !ok {
+			return "", nil, invalidArgs(fmt.Errorf("missing value for named argument %q", name))
+		}
+		bound[i] = value
+	}
+	return parsed.sql, bound, nil
+}
+
+// namedArgsBinder returns the binder of named arguments, when it is the only argument.
+func namedArgsBinder(args []interface{}) (dbconnector.NamedArgsBinder, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	binder, ok := args[0].(dbconnector.NamedArgsBinder)
+	return binder, ok
+}
+
+// errorRow is a Row that fails with the error found before the query was sent.
+type errorRow struct {
+	err error
+}
+
+func (r *errorRow) Scan(dest ...interface{}) error {
+	return r.err
+}
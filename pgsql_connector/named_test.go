@@ -0,0 +1,123 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fkmatsuda/dbconnector"
+	"github.com/fkmatsuda/dbconnector/test"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNamedQuery(t *testing.T) {
+
+	t.Run("Test rewrite placeholders", func(t *testing.T) {
+		parsed, err := parseNamedQuery("insert into t (id, name, alias) values (:id, @name, :name) on conflict (id) do update set name = :name")
+		assert.NoError(t, err)
+		assert.Equal(t, "insert into t (id, name, alias) values ($1, $2, $2) on conflict (id) do update set name = $2", parsed.sql)
+		assert.Equal(t, []string{"id", "name"}, parsed.names)
+	})
+
+	t.Run("Test casts, literals and comments", func(t *testing.T) {
+		parsed, err := parseNamedQuery("select ':a', \":b\", $$:c$$, created::date -- :d\nfrom t /* @e */ where id = :id::int and tags @> :tags")
+		assert.NoError(t, err)
+		assert.Equal(t, "select ':a', \":b\", $$:c$$, created::date -- :d\nfrom t /* @e */ where id = $1::int and tags @> $2", parsed.sql)
+		assert.Equal(t, []string{"id", "tags"}, parsed.names)
+	})
+
+	t.Run("Test invalid queries", func(t *testing.T) {
+		_, err := parseNamedQuery("select * from t where id = $1 and name = :name")
+		assert.Error(t, err)
+		_, err = parseNamedQuery("select * from t")
+		assert.Error(t, err)
+	})
+}
+
+func TestNamedQueryCache(t *testing.T) {
+	cache := newNamedQueryCache()
+	first, err := cache.get("select :id")
+	assert.NoError(t, err)
+	for i := 1; i < namedQueryCacheSize; i++ {
+		_, err := cache.get(fmt.Sprintf("select :id, %d", i))
+		assert.NoError(t, err)
+		if i == namedQueryCacheSize/2 {
+			// the first query stays recently used
+			_, err = cache.get("select :id")
+			assert.NoError(t, err)
+		}
+	}
+	// the cache is full, the least recently used query is evicted
+	_, err = cache.get("select :name")
+	assert.NoError(t, err)
+	assert.Len(t, cache.entries, namedQueryCacheSize)
+	assert.NotContains(t, cache.entries, "select :id, 1")
+	parsed, err := cache.get("select :id")
+	assert.NoError(t, err)
+	assert.Same(t, first, parsed)
+}
+
+func TestBindNamedArgs(t *testing.T) {
+	database := &PgsqlDatabase{
+		config:    test.NewMockTenantConfig("named", "Named", ""),
+		connector: &PgsqlConnector{namedQueries: newNamedQueryCache()},
+	}
+	const query = "select * from t where id = :id and name = :name"
+
+	t.Run("Test map", func(t *testing.T) {
+		sql, args, err := database.bindNamedArgs(query, []interface{}{dbconnector.NamedArgs{"id": 1, "name": "test"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "select * from t where id = $1 and name = $2", sql)
+		assert.Equal(t, []interface{}{1, "test"}, args)
+	})
+
+	t.Run("Test struct", func(t *testing.T) {
+		type base struct {
+			ID int `db:"id"`
+		}
+		type row struct {
+			base
+			Name   string
+			Secret string `db:"-"`
+		}
+		_, args, err := database.bindNamedArgs(query, []interface{}{dbconnector.StructArgs(&row{base: base{ID: 2}, Name: "test"})})
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{2, "test"}, args)
+	})
+
+	t.Run("Test missing argument", func(t *testing.T) {
+		_, _, err := database.bindNamedArgs(query, []interface{}{dbconnector.NamedArgs{"id": 1}})
+		assert.True(t, errorex.Is(err, dbconnector.ErrCodeInvalidQueryArgs))
+	})
+
+	t.Run("Test positional arguments", func(t *testing.T) {
+		sql, args, err := database.bindNamedArgs("select $1", []interface{}{1})
+		assert.NoError(t, err)
+		assert.Equal(t, "select $1", sql)
+		assert.Equal(t, []interface{}{1}, args)
+	})
+}
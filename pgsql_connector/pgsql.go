@@ -25,23 +25,67 @@ package pgsql_connector
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fkmatsuda/dbconnector"
 
 	"github.com/fkmatsuda/errorex"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// the optional interfaces implemented on top of dbconnector.Connector and dbconnector.Database
+var (
+	_ dbconnector.ReadOnlyConnector   = (*PgsqlConnector)(nil)
+	_ dbconnector.TenantLister        = (*PgsqlConnector)(nil)
+	_ dbconnector.HealthChecker       = (*PgsqlConnector)(nil)
+	_ dbconnector.PoolStatsReporter   = (*PgsqlConnector)(nil)
+	_ dbconnector.QueryStatsReporter  = (*PgsqlConnector)(nil)
+	_ dbconnector.ConnectorCloser     = (*PgsqlConnector)(nil)
+	_ dbconnector.Executor            = (*PgsqlDatabase)(nil)
+	_ dbconnector.StatementRunner     = (*PgsqlDatabase)(nil)
+	_ dbconnector.StatementRunner     = (*PgsqlTransaction)(nil)
+	_ dbconnector.ReturningIDExecutor = (*PgsqlTransaction)(nil)
+	_ dbconnector.KeyResult           = (*PgsqlResult)(nil)
+	_ dbconnector.ValueRows           = (*pgsqlRows)(nil)
 )
 
 // PgsqlConnector is the struct for the PostgreSQL connector.
 type PgsqlConnector struct {
+	mu                    sync.RWMutex
 	tenantProvider        dbconnector.TenantProvider
 	tenantsConfig         []dbconnector.TenantConfig
 	tenantsConfigIndexMap map[string]int
+	namedQueries          *namedQueryCache
+	normalizedQueries     *normalizedQueryCache
+	statements            *statementRegistry
+	pools                 map[string]*pgxpool.Pool
+	tenantIDVariable      string
+	replicas              *replicaRouter
+	acquireFailures       *failureCounter
+	trackLSN              bool
+	tracer                dbconnector.Tracer
+	logger                *slog.Logger
+	slowQueryThreshold    time.Duration
+	slowQueryHandler      SlowQueryHandler
+	explainSlots          chan struct{}
+	queryStats            *queryStatsCache
+	budget                *connectionBudget
+	eviction              PoolEviction
+	evictionObservers     []PoolEvictionObserver
+	// lastUsed is the last use of each pool, in Unix nanoseconds
+	lastUsed    map[string]*atomic.Int64
+	stopMonitor context.CancelFunc
+	closed      bool
 }
 
 // NewConnector creates a new database connector.
-func NewConnector(tenantProvider dbconnector.TenantProvider) (dbconnector.Connector, error) {
+func NewConnector(tenantProvider dbconnector.TenantProvider, opts ...Option) (dbconnector.Connector, error) {
 
 	// configure tenant provider
 	err := tenantProvider.Configure()
@@ -56,47 +100,108 @@ func NewConnector(tenantProvider dbconnector.TenantProvider) (dbconnector.Connec
 	}
 
 	// create connector
-	connector := PgsqlConnector{
+	connector := &PgsqlConnector{
 		tenantProvider:        tenantProvider,
 		tenantsConfig:         tenantsConfig,
 		tenantsConfigIndexMap: make(map[string]int),
+		namedQueries:          newNamedQueryCache(),
+		normalizedQueries:     newNormalizedQueryCache(),
+		statements:            newStatementRegistry(),
+		pools:                 make(map[string]*pgxpool.Pool),
+		lastUsed:              make(map[string]*atomic.Int64),
+		replicas:              newReplicaRouter(),
+		acquireFailures:       newFailureCounter(),
+		logger:                slog.New(discardHandler{}),
+	}
+	for _, opt := range opts {
+		opt(connector)
 	}
 
 	// load tenants
-	err = (&connector).Reload()
+	err = connector.Reload()
 	if err != nil {
 		return nil, err
 	}
 
-	return &connector, nil
+	// the monitors run until Close, once the connector is returned
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	connector.stopMonitor = stopMonitor
+	if connector.replicas.maxLag > 0 {
+		go connector.monitorReplicaLag(monitorCtx)
+	}
+	if connector.eviction.IdleTimeout > 0 {
+		go connector.monitorIdlePools(monitorCtx)
+	}
+
+	return connector, nil
 }
 
 // a pointer to PgsqlConnector must implement Connector
 
 // Connect connects to the database.
 func (c *PgsqlConnector) Connect(ctx context.Context, tenantID string) (dbconnector.Database, error) {
-	// get tenant index
-	tenantIndex, ok := c.tenantsConfigIndexMap[tenantID]
+	// get tenant config
+	tenantConfig, ok := c.Tenant(tenantID)
 	if !ok {
 		return nil, errorex.New(dbconnector.ErrCodeTenantNotFound, dbconnector.TenantErrorDetail{TenantID: tenantID})
 	}
-	// get tenant config
-	tenantConfig := c.tenantsConfig[tenantIndex]
+	return c.ConnectConfig(ctx, tenantConfig)
+}
+
+// ConnectConfig connects to the database of a tenant config, which need not be loaded
+// by the tenant provider, e.g. a tenant being provisioned.
+func (c *PgsqlConnector) ConnectConfig(ctx context.Context, tenantConfig dbconnector.TenantConfig) (dbconnector.Database, error) {
+	if err := checkNotSuspended(tenantConfig); err != nil {
+		return nil, err
+	}
 	// obter o database
-	database, err := c.connect(ctx, tenantConfig)
+	database, err := c.connect(ctx, tenantConfig, tenantConfig.DatabaseURL(), false)
 	if err != nil {
 		return nil, err
 	}
 	return database, nil
 }
 
-func (c *PgsqlConnector) connect(ctx context.Context, config dbconnector.TenantConfig) (*PgsqlDatabase, error) {
-	// get database url
-	databaseURL := config.DatabaseURL()
+func checkNotSuspended(tenantConfig dbconnector.TenantConfig) error {
+	if dbconnector.TenantMetadataOf(tenantConfig).Status == dbconnector.TenantStatusSuspended {
+		return errorex.New(dbconnector.ErrCodeTenantSuspended, dbconnector.TenantErrorDetail{TenantID: tenantConfig.TenantID()})
+	}
+	return nil
+}
+
+// ConnectFromContext connects to the database of the tenant carried by ctx.
+func (c *PgsqlConnector) ConnectFromContext(ctx context.Context) (dbconnector.Database, error) {
+	return dbconnector.ConnectFromContext(ctx, c)
+}
 
-	// connect to the database
-	conn, err := pgx.Connect(ctx, databaseURL)
+// Tenant returns the current config of a tenant.
+func (c *PgsqlConnector) Tenant(tenantID string) (dbconnector.TenantConfig, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tenantIndex, ok := c.tenantsConfigIndexMap[tenantID]
+	if !ok {
+		return nil, false
+	}
+	return c.tenantsConfig[tenantIndex], true
+}
+
+func (c *PgsqlConnector) connect(ctx context.Context, config dbconnector.TenantConfig, databaseURL string, readOnly bool) (*PgsqlDatabase, error) {
+	// acquire a connection from the database pool
+	session, variables := c.sessionSettings(config, readOnly)
+	traceCtx, end := c.startTrace(ctx, dbconnector.TraceConnect, config.TenantID(), "", 0, false, nil)
+	conn, release, err := c.acquire(traceCtx, databaseURL, config, session)
+	end(0, err)
+	if err != nil && ctx.Err() == context.Canceled {
+		// the caller went away, the connection did not fail
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		c.acquireFailures.add(failureKey{tenantID: config.TenantID(), role: poolRole(config, databaseURL)})
+		if errorex.Is(err, dbconnector.ErrCodeAcquireTimeout) {
+			c.logger.Warn("connection budget exhausted", "tenant", config.TenantID(), "database", redactURL(databaseURL))
+			return nil, err
+		}
+		c.logger.Warn("connection failed", "tenant", config.TenantID(), "database", redactURL(databaseURL), "error", err)
 		return nil, errorex.New(dbconnector.ErrCodeConnectionFailed, dbconnector.DatabaseErrorDetail{
 			TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: config.TenantID()},
 			DatabaseError:     err.Error(),
@@ -104,13 +209,37 @@ func (c *PgsqlConnector) connect(ctx context.Context, config dbconnector.TenantC
 	}
 	// fill the database struct
 	database := PgsqlDatabase{
-		config:    config,
-		connector: c,
-		conn:      conn,
+		config:      config,
+		connector:   c,
+		conn:        conn,
+		databaseURL: databaseURL,
+		release:     release,
+		session:     session,
+		variables:   variables,
+		readOnly:    readOnly,
 	}
 	return &database, nil
 }
 
+// Tenants returns the current tenants.
+func (c *PgsqlConnector) Tenants() []dbconnector.TenantConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tenants := make([]dbconnector.TenantConfig, len(c.tenantsConfig))
+	copy(tenants, c.tenantsConfig)
+	return tenants
+}
+
+// FindTenants returns the current tenants whose labels satisfy the selector.
+func (c *PgsqlConnector) FindTenants(selector dbconnector.LabelSelector) []dbconnector.TenantConfig {
+	return dbconnector.FindTenants(c, selector)
+}
+
+// ForEachTenant runs fn against the database of each current tenant.
+func (c *PgsqlConnector) ForEachTenant(ctx context.Context, opts dbconnector.ForEachOptions, fn dbconnector.TenantFunc) *dbconnector.ForEachResult {
+	return dbconnector.ForEachTenant(ctx, c, opts, fn)
+}
+
 // Reload reloads the tenants and reconfigure the database pool.
 func (c *PgsqlConnector) Reload() error {
 	// load tenants
@@ -119,21 +248,73 @@ func (c *PgsqlConnector) Reload() error {
 		return err
 	}
 
-	c.tenantsConfigIndexMap = make(map[string]int)
+	tenantsConfigIndexMap := make(map[string]int)
+	databaseURLs := make(map[string]bool)
 
 	// fill the index map
 	for idx, tenantConfig := range tenantsConfig {
-		c.tenantsConfigIndexMap[tenantConfig.TenantID()] = idx
+		tenantsConfigIndexMap[tenantConfig.TenantID()] = idx
+		databaseURLs[tenantConfig.DatabaseURL()] = true
+		for _, replicaURL := range dbconnector.TenantReplicaURLs(tenantConfig) {
+			databaseURLs[replicaURL] = true
+		}
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logReload(c.tenantsConfig, tenantsConfig)
+	c.tenantsConfig = tenantsConfig
+	c.tenantsConfigIndexMap = tenantsConfigIndexMap
+
+	// drop the pools no tenant uses anymore
+	for databaseURL, pool := range c.pools {
+		if !databaseURLs[databaseURL] {
+			delete(c.pools, databaseURL)
+			delete(c.lastUsed, databaseURL)
+			c.logger.Info("pool closed", "database", redactURL(databaseURL))
+			// Close waits for the acquired connections to be released
+			go pool.Close()
+		}
+	}
+	c.replicas.retain(databaseURLs)
+	c.acquireFailures.retain(tenantsConfigIndexMap)
+
 	return nil
 }
 
+// Close closes every database pool.
+func (c *PgsqlConnector) Close() {
+	c.stopMonitor()
+	c.mu.Lock()
+	c.closed = true
+	pools := c.pools
+	c.pools = make(map[string]*pgxpool.Pool)
+	c.lastUsed = make(map[string]*atomic.Int64)
+	c.mu.Unlock()
+
+	for _, pool := range pools {
+		pool.Close()
+	}
+	c.logger.Debug("connector closed", "pools", len(pools))
+}
+
 // PgsqlDatabase is the struct for the PostgreSQL database.
 type PgsqlDatabase struct {
 	config    dbconnector.TenantConfig
 	connector *PgsqlConnector
-	conn      *pgx.Conn
+	conn      *pgxpool.Conn
+	// databaseURL is the database the connection was acquired from
+	databaseURL string
+	// release releases the lease of the connection under a connection budget
+	release   func()
+	session   []sessionSetting
+	variables []sessionSetting
+	readOnly  bool
+	lastLSN   string
+	closed    bool
+	// discard closes the connection instead of returning it to the pool, e.g. when a stale
+	// statement could not be deallocated
+	discard bool
 }
 
 // TenantConfig returns the tenant config.
@@ -143,51 +324,108 @@ func (p *PgsqlDatabase) TenantConfig() dbconnector.TenantConfig {
 
 // PgxConn returns the pgx connection.
 func (p *PgsqlDatabase) PgxConn() *pgx.Conn {
-	return p.conn
+	return p.conn.Conn()
 }
 
+// Close returns the connection to the tenant pool. Closing it again does nothing.
 func (p *PgsqlDatabase) Close(ctx context.Context) error {
-	err := p.conn.Close(ctx)
-	if err == nil {
+	if p.closed {
 		return nil
 	}
-	return errorex.New(dbconnector.ErrCodeCloseFailed, dbconnector.DatabaseErrorDetail{
-		TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
-		DatabaseError:     err.Error(),
-	})
+	p.closed = true
+	var err error
+	if p.discard {
+		// the pool destroys closed connections on release
+		err = p.conn.Conn().Close(ctx)
+	} else {
+		err = resetSession(p.conn, p.session)
+	}
+	p.conn.Release()
+	p.release()
+	p.connector.touch(p.databaseURL)
+	if err != nil {
+		return errorex.New(dbconnector.ErrCodeCloseFailed, dbconnector.DatabaseErrorDetail{
+			TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
+			DatabaseError:     err.Error(),
+		})
+	}
+	return nil
 }
 
 // Query executes a query.
 func (p *PgsqlDatabase) Query(ctx context.Context, query string, args ...interface{}) (dbconnector.Rows, error) {
+	query, args, err := p.bindNamedArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
 	// executar a query
+	ctx, end := p.traceStatement(ctx, dbconnector.TraceQuery, query, args)
 	rows, err := p.conn.Query(ctx, query, args...)
 	if err != nil {
-		return nil, errorex.New(dbconnector.ErrCodeQueryFailed,
-			dbconnector.QueryErrorDetail{
-				DatabaseErrorDetail: dbconnector.DatabaseErrorDetail{
-					TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
-					DatabaseError:     err.Error(),
-				},
-				QueryScript: query,
-				QueryArgs:   args,
-			},
-		)
+		end(0, err)
+		return nil, p.queryError(err, query, args)
 	}
 	return &pgsqlRows{
 		rows: rows,
+		end:  end,
 	}, nil
 }
 
+// queryError converts a query error to errorex.
+func (p *PgsqlDatabase) queryError(err error, query string, args []interface{}) error {
+	return errorex.New(dbconnector.ErrCodeQueryFailed,
+		dbconnector.QueryErrorDetail{
+			DatabaseErrorDetail: dbconnector.DatabaseErrorDetail{
+				TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
+				DatabaseError:     err.Error(),
+			},
+			QueryScript: query,
+			QueryArgs:   args,
+		},
+	)
+}
+
 // QueryRow executes a query and returns a row.
 func (p *PgsqlDatabase) QueryRow(ctx context.Context, query string, args ...interface{}) dbconnector.Row {
+	query, args, err := p.bindNamedArgs(query, args)
+	if err != nil {
+		return &errorRow{err: err}
+	}
 	// executar a query
-	return p.conn.QueryRow(ctx, query, args...)
+	ctx, end := p.traceStatement(ctx, dbconnector.TraceQuery, query, args)
+	return p.traceRow(p.conn.QueryRow(ctx, query, args...), end)
+}
+
+// Exec executes a query outside a transaction.
+func (p *PgsqlDatabase) Exec(ctx context.Context, query string, args ...interface{}) (dbconnector.Result, error) {
+	if err := p.checkWritable(); err != nil {
+		return nil, err
+	}
+	query, args, err := p.bindNamedArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, end := p.traceStatement(ctx, dbconnector.TraceExec, query, args)
+	result, err := p.conn.Exec(ctx, query, args...)
+	end(result.RowsAffected(), err)
+	if err != nil {
+		return nil, err
+	}
+	return &PgsqlResult{
+		database: p,
+		result:   result,
+	}, nil
 }
 
 // RunInTransaction runs a function in a transaction.
 func (p *PgsqlDatabase) RunInTransaction(ctx context.Context, fn dbconnector.TransactionFN) error {
+	// join the ambient transaction
+	if tx, ok := dbconnector.AmbientTransaction(ctx, p.TenantConfig().TenantID()); ok {
+		return fn(ctx, tx)
+	}
+
 	// create a pgx transaction
-	pgxTx, err := p.conn.Begin(ctx)
+	pgxTx, err := p.BeginTx(ctx, p.TxOptions(ctx))
 	if err != nil {
 		return errorex.New(dbconnector.ErrCodeCannotBeginTx,
 			dbconnector.DatabaseErrorDetail{
@@ -200,10 +438,51 @@ func (p *PgsqlDatabase) RunInTransaction(ctx context.Context, fn dbconnector.Tra
 	// fill the transaction
 	tx := p.CreateTx(pgxTx)
 
+	// set the session variables of the tenant for the transaction
+	err = p.SetLocalVariables(ctx, pgxTx)
+	if err != nil {
+		_ = pgxTx.Rollback(ctx)
+		return errorex.New(dbconnector.ErrCodeCannotBeginTx,
+			dbconnector.DatabaseErrorDetail{
+				TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
+				DatabaseError:     err.Error(),
+			},
+		)
+	}
+
 	// run the function
-	err = fn(ctx, tx)
+	err = fn(dbconnector.WithTransaction(ctx, tx), tx)
 
-	return tx.CommitOrRollback(ctx, err)
+	if err := tx.CommitOrRollback(ctx, err); err != nil {
+		return err
+	}
+	if p.connector.trackLSN && !p.ReadOnly() {
+		// the commit succeeded, a missing LSN only costs read-your-writes
+		p.lastLSN, _ = p.CurrentLSN(ctx)
+	}
+	return nil
+}
+
+// TxOptions returns the options of the transactions of the tenant, which are read-only for
+// read-only tenants and when ctx asks for it.
+func (p *PgsqlDatabase) TxOptions(ctx context.Context) pgx.TxOptions {
+	if p.ReadOnly() || dbconnector.ReadOnlyFromContext(ctx) {
+		return pgx.TxOptions{AccessMode: pgx.ReadOnly}
+	}
+	return pgx.TxOptions{}
+}
+
+// ReadOnly reports whether the tenant is read-only or the database was connected by ConnectReadOnly.
+func (p *PgsqlDatabase) ReadOnly() bool {
+	return p.readOnly || dbconnector.TenantMetadataOf(p.config).Status == dbconnector.TenantStatusReadOnly
+}
+
+// checkWritable rejects statements that write on read-only tenants.
+func (p *PgsqlDatabase) checkWritable() error {
+	if p.ReadOnly() {
+		return errorex.New(dbconnector.ErrCodeTenantReadOnly, dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()})
+	}
+	return nil
 }
 
 func (p *PgsqlDatabase) CreateTx(pgxTx pgx.Tx) *PgsqlTransaction {
@@ -214,24 +493,66 @@ func (p *PgsqlDatabase) CreateTx(pgxTx pgx.Tx) *PgsqlTransaction {
 	return &tx
 }
 
+// DefaultIDColumn is the column returned by ExecReturningID when the query has no RETURNING clause.
+const DefaultIDColumn = "id"
+
 // PgsqlResult is the struct for the PostgreSQL result.
 type PgsqlResult struct {
-	database *PgsqlDatabase
-	result   pgconn.CommandTag
+	database     *PgsqlDatabase
+	result       pgconn.CommandTag
+	lastInsertID interface{}
 }
 
 // LastInsertId returns the last insert id.
+// It is only available for integer keys captured by ExecReturningID.
 func (p *PgsqlResult) LastInsertId() (int64, error) {
+	if id, ok := p.lastInsertID.(int64); ok {
+		return id, nil
+	}
 	return 0, errorex.New(dbconnector.ErrCodeNotSupported, dbconnector.TenantErrorDetail{
 		TenantID: p.database.TenantConfig().TenantID(),
 	})
 }
 
+// LastInsertKey returns the last insert key captured by ExecReturningID.
+func (p *PgsqlResult) LastInsertKey() (interface{}, error) {
+	if p.lastInsertID == nil {
+		return nil, errorex.New(dbconnector.ErrCodeNotSupported, dbconnector.TenantErrorDetail{
+			TenantID: p.database.TenantConfig().TenantID(),
+		})
+	}
+	return p.lastInsertID, nil
+}
+
 // RowsAffected returns the number of rows affected.
 func (p *PgsqlResult) RowsAffected() (int64, error) {
 	return p.result.RowsAffected(), nil
 }
 
+// returningQuery appends a RETURNING clause for the given column unless the query already has one.
+func returningQuery(query, column string) string {
+	tokens := scanSQL(query)
+	if hasTopLevelKeyword(tokens, "returning") {
+		return query
+	}
+	return trimStatement(query, tokens) + " RETURNING " + pgx.Identifier{column}.Sanitize()
+}
+
+// insertKey normalizes a generated key to int64 for serial and identity columns and to a string for UUIDs.
+func insertKey(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case [16]byte:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16])
+	}
+	return value
+}
+
 // PgsqlTransaction is the struct for the PostgreSQL transaction.
 type PgsqlTransaction struct {
 	database *PgsqlDatabase
@@ -245,40 +566,94 @@ func (p *PgsqlTransaction) TenantConfig() dbconnector.TenantConfig {
 
 // Query executes a query.
 func (p *PgsqlTransaction) Query(ctx context.Context, query string, args ...interface{}) (dbconnector.Rows, error) {
+	query, args, err := p.database.bindNamedArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
 	// execute the query
+	ctx, end := p.database.traceStatement(ctx, dbconnector.TraceQuery, query, args)
 	pgRow, err := p.tx.Query(ctx, query, args...)
 	if err != nil {
-		return nil, errorex.New(dbconnector.ErrCodeQueryFailed,
-			dbconnector.QueryErrorDetail{
-				DatabaseErrorDetail: dbconnector.DatabaseErrorDetail{
-					TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.database.TenantConfig().TenantID()},
-					DatabaseError:     err.Error(),
-				},
-				QueryScript: query,
-				QueryArgs:   args,
-			},
-		)
+		end(0, err)
+		return nil, p.database.queryError(err, query, args)
 	}
 	return &pgsqlRows{
 		rows: pgRow,
+		end:  end,
 	}, nil
 }
 
 // QueryRow executes a query and returns a row.
 func (p *PgsqlTransaction) QueryRow(ctx context.Context, query string, args ...interface{}) dbconnector.Row {
+	query, args, err := p.database.bindNamedArgs(query, args)
+	if err != nil {
+		return &errorRow{err: err}
+	}
 	// execute the query
-	return p.tx.QueryRow(ctx, query, args...)
+	ctx, end := p.database.traceStatement(ctx, dbconnector.TraceQuery, query, args)
+	return p.database.traceRow(p.tx.QueryRow(ctx, query, args...), end)
 }
 
 // Exec executes a query.
 func (p *PgsqlTransaction) Exec(ctx context.Context, query string, args ...interface{}) (dbconnector.Result, error) {
+	if err := p.database.checkWritable(); err != nil {
+		return nil, err
+	}
+	query, args, err := p.database.bindNamedArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
 	// executar a query
+	ctx, end := p.database.traceStatement(ctx, dbconnector.TraceExec, query, args)
 	result, err := p.tx.Exec(ctx, query, args...)
+	end(result.RowsAffected(), err)
+	if err != nil {
+		return nil, err
+	}
+	return &PgsqlResult{
+		database: p.database,
+		result:   result,
+	}, nil
+}
+
+// ExecReturningID executes an insert and captures the generated key of the last inserted row.
+func (p *PgsqlTransaction) ExecReturningID(ctx context.Context, query string, args ...interface{}) (dbconnector.Result, error) {
+	if err := p.database.checkWritable(); err != nil {
+		return nil, err
+	}
+	query, args, err := p.database.bindNamedArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
+	query = returningQuery(query, DefaultIDColumn)
+	ctx, end := p.database.traceStatement(ctx, dbconnector.TraceExec, query, args)
+	rows, err := p.tx.Query(ctx, query, args...)
 	if err != nil {
+		end(0, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lastInsertID interface{}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			end(0, err)
+			return nil, err
+		}
+		if len(values) > 0 {
+			lastInsertID = insertKey(values[0])
+		}
+	}
+	rows.Close()
+	end(rows.CommandTag().RowsAffected(), rows.Err())
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 	return &PgsqlResult{
-		result: result,
+		database:     p.database,
+		result:       rows.CommandTag(),
+		lastInsertID: lastInsertID,
 	}, nil
 }
 
@@ -290,24 +665,29 @@ func (p *PgsqlTransaction) CommitOrRollback(ctx context.Context, err error) erro
 		// rollback the transaction
 		errRollback := p.tx.Rollback(ctx)
 		if errRollback != nil {
+			p.database.Logger().Error("rollback failed", "error", errRollback, "cause", err)
 			return errorex.New(dbconnector.ErrCodeCannotRollbackTx, dbconnector.RollbackErrorDetail{
 				DatabaseError: errorConverter.ConvertError(errRollback),
 				OriginalError: errEX,
 			})
 		}
+		p.database.Logger().Info("transaction rolled back", "cause", err)
 		return errEX
 
 	}
 	// commit the transaction
 	errCommit := p.tx.Commit(ctx)
-	if err != nil {
+	if errCommit != nil {
+		p.database.Logger().Warn("commit failed", "error", errCommit)
 		return errorConverter.ConvertError(errCommit)
 	}
 	return nil
 }
 
 type pgsqlRows struct {
-	rows pgx.Rows
+	rows    pgx.Rows
+	onError func(err error)
+	end     endTrace
 }
 
 func (p *pgsqlRows) Scan(dest ...interface{}) error {
@@ -315,14 +695,45 @@ func (p *pgsqlRows) Scan(dest ...interface{}) error {
 }
 
 func (p *pgsqlRows) Next() bool {
-	return p.rows.Next()
+	if p.rows.Next() {
+		return true
+	}
+	// the rows are closed once read
+	p.endTrace()
+	return false
 }
 
 func (p *pgsqlRows) Err() error {
-	return p.rows.Err()
+	err := p.rows.Err()
+	if err != nil && p.onError != nil {
+		p.onError(err)
+	}
+	return err
+}
+
+func (p *pgsqlRows) Columns() []string {
+	fields := p.rows.FieldDescriptions()
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = field.Name
+	}
+	return columns
+}
+
+func (p *pgsqlRows) Values() ([]interface{}, error) {
+	return p.rows.Values()
 }
 
 func (p *pgsqlRows) Close() error {
 	p.rows.Close()
+	p.endTrace()
 	return nil
 }
+
+// endTrace ends the trace of the query once.
+func (p *pgsqlRows) endTrace() {
+	if p.end != nil {
+		p.end(p.rows.CommandTag().RowsAffected(), p.rows.Err())
+		p.end = nil
+	}
+}
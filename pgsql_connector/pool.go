@@ -0,0 +1,129 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pool returns the connection pool of a database, creating it on first use with the
+// connection settings of the tenant. Tenants that share a database URL, such as
+// schema-per-tenant ones, share its pool, which keeps the settings of the first tenant.
+func (c *PgsqlConnector) pool(databaseURL string, config dbconnector.TenantConfig) (*pgxpool.Pool, error) {
+	c.mu.RLock()
+	pool, ok := c.pools[databaseURL]
+	c.mu.RUnlock()
+	if ok {
+		return pool, nil
+	}
+
+	pool, created, err := c.createPool(databaseURL, config)
+	if created && c.eviction.MaxLivePools > 0 {
+		c.evictPools(0, c.eviction.MaxLivePools, databaseURL)
+	}
+	return pool, err
+}
+
+// createPool creates the pool of a database, unless another connection created it meanwhile.
+func (c *PgsqlConnector) createPool(databaseURL string, config dbconnector.TenantConfig) (*pgxpool.Pool, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok := c.pools[databaseURL]; ok {
+		return pool, false, nil
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, false, err
+	}
+	poolConfig.AfterConnect = c.prepareStatements
+	applyConnectionSettings(poolConfig, dbconnector.TenantMetadataOf(config).ConnectionSettings)
+
+	// the pool outlives the context of the request that created it
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, false, err
+	}
+	c.pools[databaseURL] = pool
+	c.lastUsed[databaseURL] = newLastUsed()
+	c.logger.Info("pool created", "tenant", config.TenantID(), "database", redactURL(databaseURL), "max_conns", poolConfig.MaxConns)
+	return pool, true, nil
+}
+
+// acquire acquires a connection from the pool of a database and applies the session settings of the tenant.
+// Under a connection budget, the connection holds a lease that the returned function releases.
+func (c *PgsqlConnector) acquire(ctx context.Context, databaseURL string, config dbconnector.TenantConfig, session []sessionSetting) (*pgxpool.Conn, func(), error) {
+	pool, err := c.pool(databaseURL, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {}
+	if c.budget != nil {
+		if release, err = c.budget.reserve(ctx, databaseURL, config); err != nil {
+			return nil, nil, err
+		}
+		c.evictIdle(ctx, databaseURL)
+	}
+	conn, err := pool.Acquire(ctx)
+	if err != nil && c.evicted(databaseURL, pool) {
+		// the pool was evicted meanwhile, it is created again
+		if pool, err = c.pool(databaseURL, config); err == nil {
+			conn, err = pool.Acquire(ctx)
+		}
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	c.touch(databaseURL)
+	if err := applySession(ctx, conn.Conn(), session); err != nil {
+		conn.Release()
+		release()
+		return nil, nil, err
+	}
+	return conn, release, nil
+}
+
+// applyConnectionSettings overrides the pool defaults with the non-zero connection settings.
+func applyConnectionSettings(poolConfig *pgxpool.Config, settings dbconnector.ConnectionSettings) {
+	if settings.MaxConns > 0 {
+		poolConfig.MaxConns = settings.MaxConns
+	}
+	if settings.MinConns > 0 {
+		poolConfig.MinConns = settings.MinConns
+	}
+	if settings.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = settings.MaxConnLifetime
+	}
+	if settings.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = settings.MaxConnIdleTime
+	}
+	if settings.ConnectTimeout > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = settings.ConnectTimeout
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fkmatsuda/dbconnector"
+)
+
+// DefaultQueryStatsSize is the number of statements WithQueryStats keeps by default.
+const DefaultQueryStatsSize = 5000
+
+// normalizedQueryCacheSize is the maximum number of normalized statements kept by a connector.
+const normalizedQueryCacheSize = 1024
+
+// WithQueryStats aggregates the queries, execs, batches and copies of each tenant by fingerprint,
+// the fingerprint of the normalized SQL. The least recently run statements are dropped beyond
+// size entries, DefaultQueryStatsSize when size is not positive.
+func WithQueryStats(size int) Option {
+	return func(c *PgsqlConnector) {
+		if size <= 0 {
+			size = DefaultQueryStatsSize
+		}
+		c.queryStats = newQueryStatsCache(size)
+	}
+}
+
+// fingerprint identifies a normalized statement.
+func fingerprint(normalizedSQL string) string {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(normalizedSQL))
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// normalizedQuery is a statement normalized by normalizeSQL, with its fingerprint.
+type normalizedQuery struct {
+	sql         string
+	fingerprint string
+}
+
+func newNormalizedQuery(query string) normalizedQuery {
+	sql := normalizeSQL(query)
+	return normalizedQuery{sql: sql, fingerprint: fingerprint(sql)}
+}
+
+// normalizedQueryCache is a bounded LRU of normalized statements by their original SQL,
+// the statements run again are not lexed again.
+type normalizedQueryCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// normalizedQueryEntry is an element of the normalizedQueryCache order.
+type normalizedQueryEntry struct {
+	query      string
+	normalized normalizedQuery
+}
+
+func newNormalizedQueryCache() *normalizedQueryCache {
+	return &normalizedQueryCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the normalized statement, normalizing and caching it on first use.
+func (c *normalizedQueryCache) get(query string) normalizedQuery {
+	c.mu.Lock()
+	if element, ok := c.entries[query]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*normalizedQueryEntry).normalized
+	}
+	c.mu.Unlock()
+
+	normalized := newNormalizedQuery(query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[query]; ok {
+		// normalized meanwhile
+		c.order.MoveToFront(element)
+		return normalized
+	}
+	c.entries[query] = c.order.PushFront(&normalizedQueryEntry{query: query, normalized: normalized})
+	if c.order.Len() > normalizedQueryCacheSize {
+		oldest := c.order.Remove(c.order.Back()).(*normalizedQueryEntry)
+		delete(c.entries, oldest.query)
+	}
+	return normalized
+}
+
+type queryStatsKey struct {
+	tenantID    string
+	fingerprint string
+}
+
+// queryStatsCache is a bounded LRU of statement statistics.
+type queryStatsCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[queryStatsKey]*list.Element
+}
+
+func newQueryStatsCache(size int) *queryStatsCache {
+	return &queryStatsCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[queryStatsKey]*list.Element),
+	}
+}
+
+// record adds a run of a statement, normalized as statement.
+func (q *queryStatsCache) record(event dbconnector.TraceEvent, statement normalizedQuery) {
+	key := queryStatsKey{tenantID: event.TenantID, fingerprint: statement.fingerprint}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	element, ok := q.entries[key]
+	if ok {
+		q.order.MoveToFront(element)
+	} else {
+		element = q.order.PushFront(&dbconnector.QueryStats{
+			TenantID:    key.tenantID,
+			Fingerprint: key.fingerprint,
+			SQL:         statement.sql,
+		})
+		q.entries[key] = element
+		if q.order.Len() > q.size {
+			oldest := q.order.Back()
+			stats := q.order.Remove(oldest).(*dbconnector.QueryStats)
+			delete(q.entries, queryStatsKey{tenantID: stats.TenantID, fingerprint: stats.Fingerprint})
+		}
+	}
+	stats := element.Value.(*dbconnector.QueryStats)
+	stats.Calls++
+	stats.TotalTime += event.Duration
+	stats.MaxTime = max(stats.MaxTime, event.Duration)
+	stats.Rows += event.RowsAffected
+	if event.Err != nil {
+		stats.Errors++
+	}
+}
+
+// snapshot returns a copy of the statistics.
+func (q *queryStatsCache) snapshot() []dbconnector.QueryStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := make([]dbconnector.QueryStats, 0, q.order.Len())
+	for element := q.order.Front(); element != nil; element = element.Next() {
+		stats = append(stats, *element.Value.(*dbconnector.QueryStats))
+	}
+	return stats
+}
+
+// reset drops the statistics.
+func (q *queryStatsCache) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.order.Init()
+	q.entries = make(map[queryStatsKey]*list.Element)
+}
+
+// QueryStats returns the statistics of the statements, sorted by tenant ID and by total time,
+// longest first. It is empty without WithQueryStats.
+func (c *PgsqlConnector) QueryStats() []dbconnector.QueryStats {
+	if c.queryStats == nil {
+		return nil
+	}
+	stats := c.queryStats.snapshot()
+	for i := range stats {
+		stats[i].Backend = Backend
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TenantID != stats[j].TenantID {
+			return stats[i].TenantID < stats[j].TenantID
+		}
+		return stats[i].TotalTime > stats[j].TotalTime
+	})
+	return stats
+}
+
+// ResetQueryStats drops the statistics of the statements.
+func (c *PgsqlConnector) ResetQueryStats() {
+	if c.queryStats != nil {
+		c.queryStats.reset()
+	}
+}
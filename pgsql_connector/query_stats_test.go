@@ -0,0 +1,86 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryStatsCache(t *testing.T) {
+	cache := newQueryStatsCache(2)
+	run := func(tenantID, sql string, duration time.Duration, err error) {
+		cache.record(dbconnector.TraceEvent{Op: dbconnector.TraceQuery, TenantID: tenantID, SQL: sql, Duration: duration, RowsAffected: 1, Err: err}, newNormalizedQuery(sql))
+	}
+
+	t.Run("Test aggregate by fingerprint", func(t *testing.T) {
+		run("acme", "select * from users where id = 1", 10*time.Millisecond, nil)
+		run("acme", "SELECT * FROM users WHERE id = 2", 30*time.Millisecond, errors.New("failed"))
+		stats := cache.snapshot()
+		if assert.Len(t, stats, 1) {
+			assert.Equal(t, "select * from users where id = ?", stats[0].SQL)
+			assert.Equal(t, fingerprint("select * from users where id = ?"), stats[0].Fingerprint)
+			assert.Equal(t, int64(2), stats[0].Calls)
+			assert.Equal(t, 40*time.Millisecond, stats[0].TotalTime)
+			assert.Equal(t, 30*time.Millisecond, stats[0].MaxTime)
+			assert.Equal(t, int64(2), stats[0].Rows)
+			assert.Equal(t, int64(1), stats[0].Errors)
+		}
+	})
+
+	t.Run("Test evict least recently run", func(t *testing.T) {
+		run("globex", "select * from users where id = 3", time.Millisecond, nil)
+		run("acme", "select * from users where id = 4", time.Millisecond, nil)
+		run("acme", "select 1", time.Millisecond, nil)
+		stats := cache.snapshot()
+		if assert.Len(t, stats, 2) {
+			assert.Equal(t, "select ?", stats[0].SQL)
+			assert.Equal(t, "acme", stats[1].TenantID)
+			assert.Equal(t, int64(3), stats[1].Calls)
+		}
+	})
+
+	t.Run("Test reset", func(t *testing.T) {
+		cache.reset()
+		assert.Empty(t, cache.snapshot())
+	})
+}
+
+func TestNormalizedQueryCache(t *testing.T) {
+	cache := newNormalizedQueryCache()
+	assert.Equal(t, newNormalizedQuery("select 1"), cache.get("SELECT 1"))
+	for i := 1; i <= normalizedQueryCacheSize; i++ {
+		cache.get(fmt.Sprintf("select %d", i))
+	}
+	// the cache is full, the least recently used statement is evicted
+	assert.Len(t, cache.entries, normalizedQueryCacheSize)
+	assert.NotContains(t, cache.entries, "SELECT 1")
+	assert.Contains(t, cache.entries, "select 1")
+}
@@ -0,0 +1,193 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+)
+
+// ReplicaBalancing is how ConnectReadOnly picks a replica among the healthy ones.
+type ReplicaBalancing int
+
+const (
+	// RoundRobin takes the replicas of a tenant in turn.
+	RoundRobin ReplicaBalancing = iota
+	// LeastConnections takes the replica whose pool has the fewest acquired connections.
+	LeastConnections
+)
+
+// DefaultReplicaRetryInterval is how long a replica that could not be connected is left out.
+const DefaultReplicaRetryInterval = 30 * time.Second
+
+// replicaRouter keeps the balancing state and the health of the replicas.
+type replicaRouter struct {
+	mu             sync.Mutex
+	balancing      ReplicaBalancing
+	retryInterval  time.Duration
+	maxLag         time.Duration
+	lagInterval    time.Duration
+	next           map[string]int
+	unhealthyUntil map[string]time.Time
+	lag            map[string]time.Duration
+}
+
+func newReplicaRouter() *replicaRouter {
+	return &replicaRouter{
+		balancing:      RoundRobin,
+		retryInterval:  DefaultReplicaRetryInterval,
+		lagInterval:    DefaultReplicaLagInterval,
+		next:           make(map[string]int),
+		unhealthyUntil: make(map[string]time.Time),
+		lag:            make(map[string]time.Duration),
+	}
+}
+
+// candidates returns the healthy replicas of a tenant, in the order they should be tried.
+func (r *replicaRouter) candidates(tenantID string, replicaURLs []string, staleness time.Duration, acquired func(databaseURL string) int32) []string {
+	r.mu.Lock()
+	now := time.Now()
+	var healthy []string
+	for _, replicaURL := range replicaURLs {
+		if until, ok := r.unhealthyUntil[replicaURL]; ok && now.Before(until) {
+			continue
+		}
+		if r.lagging(replicaURL, staleness) {
+			continue
+		}
+		healthy = append(healthy, replicaURL)
+	}
+	balancing := r.balancing
+	start := 0
+	if balancing == RoundRobin && len(healthy) > 0 {
+		start = r.next[tenantID] % len(healthy)
+		r.next[tenantID] = start + 1
+	}
+	r.mu.Unlock()
+
+	if balancing == LeastConnections {
+		// acquired locks the pools, which Reload holds while it locks the router
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return acquired(healthy[i]) < acquired(healthy[j])
+		})
+		return healthy
+	}
+	ordered := make([]string, 0, len(healthy))
+	ordered = append(ordered, healthy[start:]...)
+	return append(ordered, healthy[:start]...)
+}
+
+// markUnhealthy leaves a replica out for the retry interval.
+func (r *replicaRouter) markUnhealthy(replicaURL string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unhealthyUntil[replicaURL] = time.Now().Add(r.retryInterval)
+}
+
+// retain forgets the replicas no tenant uses anymore.
+func (r *replicaRouter) retain(databaseURLs map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for replicaURL := range r.unhealthyUntil {
+		if !databaseURLs[replicaURL] {
+			delete(r.unhealthyUntil, replicaURL)
+		}
+	}
+	for replicaURL := range r.lag {
+		if !databaseURLs[replicaURL] {
+			delete(r.lag, replicaURL)
+		}
+	}
+}
+
+// WithReplicaBalancing sets how ConnectReadOnly picks a replica, RoundRobin by default.
+func WithReplicaBalancing(balancing ReplicaBalancing) Option {
+	return func(c *PgsqlConnector) {
+		c.replicas.balancing = balancing
+	}
+}
+
+// WithReplicaRetryInterval sets how long a replica that could not be connected is left out.
+func WithReplicaRetryInterval(retryInterval time.Duration) Option {
+	return func(c *PgsqlConnector) {
+		c.replicas.retryInterval = retryInterval
+	}
+}
+
+// ConnectReadOnly connects to a healthy read replica of the tenant, or to its primary when
+// it has no replica available. The database is read-only: its transactions are READ ONLY
+// and Exec is rejected. Replicas lagging beyond the max lag, or the staleness allowed by ctx
+// (see dbconnector.WithStaleRead), are left out, and so are those that did not replay the
+// WAL up to the LSN carried by ctx (see dbconnector.WithMinLSN). A staleness is only honoured
+// on replicas when their lag is measured (see WithReplicaMaxLag), the primary is read otherwise.
+func (c *PgsqlConnector) ConnectReadOnly(ctx context.Context, tenantID string) (dbconnector.Database, error) {
+	tenantConfig, ok := c.Tenant(tenantID)
+	if !ok {
+		return nil, errorex.New(dbconnector.ErrCodeTenantNotFound, dbconnector.TenantErrorDetail{TenantID: tenantID})
+	}
+	if err := checkNotSuspended(tenantConfig); err != nil {
+		return nil, err
+	}
+
+	staleRead, _ := dbconnector.StaleReadFromContext(ctx)
+	replicaURLs := c.replicas.candidates(tenantID, dbconnector.TenantReplicaURLs(tenantConfig), staleRead.Staleness, c.acquiredConns)
+	minLSN := dbconnector.MinLSNFromContext(ctx)
+	for _, replicaURL := range replicaURLs {
+		database, err := c.connect(ctx, tenantConfig, replicaURL, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			c.logger.Warn("replica unhealthy", "tenant", tenantID, "database", redactURL(replicaURL), "error", err)
+			c.replicas.markUnhealthy(replicaURL)
+			continue
+		}
+		caughtUp, err := database.caughtUp(ctx, minLSN)
+		if err == nil && caughtUp {
+			return database, nil
+		}
+		_ = database.Close(ctx)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return c.connect(ctx, tenantConfig, tenantConfig.DatabaseURL(), true)
+}
+
+// acquiredConns returns the number of connections acquired from the pool of a database.
+func (c *PgsqlConnector) acquiredConns(databaseURL string) int32 {
+	c.mu.RLock()
+	pool, ok := c.pools[databaseURL]
+	c.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return pool.Stat().AcquiredConns()
+}
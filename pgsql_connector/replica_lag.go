@@ -0,0 +1,196 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+)
+
+// DefaultReplicaLagInterval is how often the lag of the replicas is measured.
+const DefaultReplicaLagInterval = 5 * time.Second
+
+// replicaLagSQL measures the replay lag of a replica. A replica that replayed all it received
+// has no lag however old its last transaction, a server that is not in recovery neither. The
+// lag of a replica that receives no WAL is unknown (NULL): it replayed all it received, yet it
+// falls behind the primary.
+const replicaLagSQL = `select case
+	when not pg_is_in_recovery() then 0
+	when not exists (select 1 from pg_stat_wal_receiver) then null
+	when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+	else coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)
+end::float8`
+
+// replicaCaughtUpSQL reports whether a replica replayed the WAL up to an LSN.
+const replicaCaughtUpSQL = `select case
+	when pg_is_in_recovery() then pg_last_wal_replay_lsn() >= $1::pg_lsn
+	else true
+end`
+
+// WithReplicaMaxLag leaves out the replicas whose replay lag exceeds maxLag. The lag is
+// measured in the background at the lag interval; zero, the default, disables it. The
+// replicas whose lag is unknown, not measured yet or not receiving WAL, are left out too.
+func WithReplicaMaxLag(maxLag time.Duration) Option {
+	return func(c *PgsqlConnector) {
+		c.replicas.maxLag = maxLag
+	}
+}
+
+// WithReplicaLagInterval sets how often the lag of the replicas is measured.
+func WithReplicaLagInterval(interval time.Duration) Option {
+	return func(c *PgsqlConnector) {
+		c.replicas.lagInterval = interval
+	}
+}
+
+// WithLSNTracking records the WAL position of the primary after each committed transaction
+// (see PgsqlDatabase.LastLSN), at the cost of a query, to be passed to dbconnector.WithMinLSN.
+func WithLSNTracking() Option {
+	return func(c *PgsqlConnector) {
+		c.trackLSN = true
+	}
+}
+
+// setLag records the measured lag of a replica.
+func (r *replicaRouter) setLag(replicaURL string, lag time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lag[replicaURL] = lag
+}
+
+// clearLag forgets the lag of a replica, which is unknown until it is measured again.
+func (r *replicaRouter) clearLag(replicaURL string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.lag, replicaURL)
+}
+
+// lagging reports whether a replica lags beyond the max lag, or beyond the staleness allowed
+// by the reads when there is one. The router must be locked.
+func (r *replicaRouter) lagging(replicaURL string, staleness time.Duration) bool {
+	if r.maxLag <= 0 {
+		// the lag is not measured, no replica is known to be within the staleness
+		return staleness > 0
+	}
+	lag, ok := r.lag[replicaURL]
+	if !ok {
+		// the lag is unknown
+		return true
+	}
+	maxLag := r.maxLag
+	if staleness > 0 {
+		maxLag = min(maxLag, staleness)
+	}
+	return lag > maxLag
+}
+
+// monitorReplicaLag measures the lag of the replicas until ctx is done.
+func (c *PgsqlConnector) monitorReplicaLag(ctx context.Context) {
+	c.measureReplicaLag(ctx)
+	ticker := time.NewTicker(c.replicas.lagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.measureReplicaLag(ctx)
+		}
+	}
+}
+
+func (c *PgsqlConnector) measureReplicaLag(ctx context.Context) {
+	measured := make(map[string]bool)
+	for _, tenantConfig := range c.Tenants() {
+		// the replicas of a cold tenant are not measured, so that its pools can be evicted
+		if _, ok := c.livePool(tenantConfig.DatabaseURL()); !ok {
+			continue
+		}
+		for _, replicaURL := range dbconnector.TenantReplicaURLs(tenantConfig) {
+			if measured[replicaURL] {
+				continue
+			}
+			measured[replicaURL] = true
+			lag, known, err := c.replicaLag(ctx, replicaURL, tenantConfig)
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					c.logger.Warn("replica unhealthy", "tenant", tenantConfig.TenantID(), "database", redactURL(replicaURL), "error", err)
+					c.replicas.markUnhealthy(replicaURL)
+				}
+			case !known:
+				c.logger.Warn("replica receives no WAL", "tenant", tenantConfig.TenantID(), "database", redactURL(replicaURL))
+				c.replicas.clearLag(replicaURL)
+			default:
+				c.replicas.setLag(replicaURL, lag)
+			}
+		}
+	}
+}
+
+// replicaLag measures the lag of a replica, known is false when the replica receives no WAL.
+func (c *PgsqlConnector) replicaLag(ctx context.Context, replicaURL string, tenantConfig dbconnector.TenantConfig) (lag time.Duration, known bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.replicas.lagInterval)
+	defer cancel()
+	pool, err := c.pool(replicaURL, tenantConfig)
+	if err != nil {
+		return 0, false, err
+	}
+	// the replicas of a live primary stay open with it
+	c.touch(replicaURL)
+	var seconds *float64
+	if err := pool.QueryRow(ctx, replicaLagSQL).Scan(&seconds); err != nil {
+		return 0, false, err
+	}
+	if seconds == nil {
+		return 0, false, nil
+	}
+	return time.Duration(*seconds * float64(time.Second)), true, nil
+}
+
+// caughtUp reports whether the database replayed the WAL up to the LSN, always true without LSN.
+func (p *PgsqlDatabase) caughtUp(ctx context.Context, lsn string) (bool, error) {
+	if lsn == "" {
+		return true, nil
+	}
+	var ok bool
+	err := p.conn.QueryRow(ctx, replicaCaughtUpSQL, lsn).Scan(&ok)
+	return ok, err
+}
+
+// CurrentLSN returns the current WAL position of the server, to be passed to
+// dbconnector.WithMinLSN once the writes to read back are committed.
+func (p *PgsqlDatabase) CurrentLSN(ctx context.Context) (string, error) {
+	var lsn string
+	err := p.conn.QueryRow(ctx, "select pg_current_wal_lsn()::text").Scan(&lsn)
+	return lsn, err
+}
+
+// LastLSN returns the WAL position recorded after the last committed transaction,
+// when the connector tracks it (see WithLSNTracking).
+func (p *PgsqlDatabase) LastLSN() string {
+	return p.lastLSN
+}
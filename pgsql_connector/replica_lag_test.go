@@ -0,0 +1,68 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaLagging(t *testing.T) {
+	router := newReplicaRouter()
+	router.maxLag = 10 * time.Second
+	router.lag["replica"] = 5 * time.Second
+	router.lag["lagging"] = 15 * time.Second
+
+	t.Run("Test max lag", func(t *testing.T) {
+		assert.False(t, router.lagging("replica", 0))
+		assert.True(t, router.lagging("lagging", 0))
+	})
+
+	t.Run("Test staleness below the max lag", func(t *testing.T) {
+		assert.True(t, router.lagging("replica", 2*time.Second))
+		assert.False(t, router.lagging("replica", 5*time.Second))
+	})
+
+	t.Run("Test staleness beyond the max lag", func(t *testing.T) {
+		// the staleness does not relax the max lag
+		assert.True(t, router.lagging("lagging", time.Minute))
+		assert.False(t, router.lagging("replica", time.Minute))
+	})
+
+	t.Run("Test lag unknown", func(t *testing.T) {
+		// not measured yet, or not receiving WAL
+		assert.True(t, router.lagging("unknown", 0))
+		assert.True(t, router.lagging("unknown", time.Minute))
+	})
+
+	t.Run("Test lag not measured", func(t *testing.T) {
+		unmeasured := newReplicaRouter()
+		unmeasured.lag["replica"] = time.Minute
+		assert.False(t, unmeasured.lagging("replica", 0))
+		// a bounded read falls back to the primary
+		assert.True(t, unmeasured.lagging("replica", time.Second))
+	})
+}
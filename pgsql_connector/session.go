@@ -0,0 +1,125 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// sessionSetting is a run-time parameter set on a connection while a tenant holds it.
+type sessionSetting struct {
+	name  string
+	value string
+}
+
+// sessionSettings returns the run-time parameters of the connections handed out to a tenant
+// and, among them, the session variables that every transaction sets again locally.
+func (c *PgsqlConnector) sessionSettings(config dbconnector.TenantConfig, readOnly bool) (session []sessionSetting, variables []sessionSetting) {
+	values := make(map[string]string)
+	if c.tenantIDVariable != "" {
+		values[c.tenantIDVariable] = config.TenantID()
+	}
+	for name, value := range dbconnector.TenantSessionVariables(config) {
+		values[name] = value
+	}
+	for name, value := range values {
+		variables = append(variables, sessionSetting{name: name, value: value})
+	}
+	sort.Slice(variables, func(i, j int) bool {
+		return variables[i].name < variables[j].name
+	})
+
+	if schema := dbconnector.TenantSchema(config); schema != "" {
+		session = append(session, sessionSetting{name: "search_path", value: pgx.Identifier{schema}.Sanitize()})
+	}
+	if readOnly || dbconnector.TenantMetadataOf(config).Status == dbconnector.TenantStatusReadOnly {
+		// statements outside RunInTransaction are read-only as well
+		session = append(session, sessionSetting{name: "default_transaction_read_only", value: "on"})
+	}
+	session = append(session, variables...)
+	return session, variables
+}
+
+// settingsExecutor is implemented by connections and transactions.
+type settingsExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// applySession sets the session settings on a connection.
+func applySession(ctx context.Context, conn *pgx.Conn, settings []sessionSetting) error {
+	return applySettings(ctx, conn, settings, false)
+}
+
+// SetLocalVariables sets the session variables of the tenant for the rest of the transaction (SET LOCAL),
+// so that row-level security policies see them on every statement.
+func (p *PgsqlDatabase) SetLocalVariables(ctx context.Context, tx pgx.Tx) error {
+	return applySettings(ctx, tx, p.variables, true)
+}
+
+// applySettings sets run-time parameters, for the session or for the current transaction only.
+func applySettings(ctx context.Context, executor settingsExecutor, settings []sessionSetting, local bool) error {
+	if len(settings) == 0 {
+		return nil
+	}
+	var query strings.Builder
+	args := make([]interface{}, 0, len(settings)*3)
+	query.WriteString("select ")
+	for i, setting := range settings {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("set_config($" + strconv.Itoa(len(args)+1) + ", $" + strconv.Itoa(len(args)+2) + ", $" + strconv.Itoa(len(args)+3) + ")")
+		args = append(args, setting.name, setting.value, local)
+	}
+	_, err := executor.Exec(ctx, query.String(), args...)
+	return err
+}
+
+// resetSession restores the defaults of the session settings before a connection goes back to the pool.
+// A connection that cannot be reset is closed, so that the next tenant never inherits its state.
+func resetSession(conn *pgxpool.Conn, settings []sessionSetting) error {
+	if len(settings) == 0 {
+		return nil
+	}
+	var query strings.Builder
+	for _, setting := range settings {
+		query.WriteString("reset ")
+		query.WriteString(pgx.Identifier(strings.Split(setting.name, ".")).Sanitize())
+		query.WriteString(";")
+	}
+	_, err := conn.Exec(context.Background(), query.String())
+	if err != nil {
+		_ = conn.Conn().Close(context.Background())
+	}
+	return err
+}
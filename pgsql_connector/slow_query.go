@@ -0,0 +1,156 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+)
+
+const (
+	// DefaultExplainTimeout bounds the capture of the plan of a slow query.
+	DefaultExplainTimeout = 10 * time.Second
+	// maxConcurrentExplains bounds the plans captured at once, the plans of the slow queries
+	// beyond it are skipped.
+	maxConcurrentExplains = 2
+)
+
+// SlowQuery is a statement that lasted at least the slow query threshold.
+type SlowQuery struct {
+	TenantID string
+	Op       dbconnector.TraceOp
+	// SQL is the normalized statement, without its literals.
+	SQL          string
+	Duration     time.Duration
+	RowsAffected int64
+	Err          error
+	// Plan is the EXPLAIN (FORMAT JSON) output of the statement, when plans are captured.
+	Plan json.RawMessage
+	// PlanErr is the error of the capture of the plan.
+	PlanErr error
+}
+
+// SlowQueryHandler receives the slow queries.
+type SlowQueryHandler func(query SlowQuery)
+
+// WithSlowQueryThreshold reports the queries, execs, batches and copies that last at least
+// threshold. They are logged at warn level and handed to the slow query handler.
+func WithSlowQueryThreshold(threshold time.Duration) Option {
+	return func(c *PgsqlConnector) {
+		c.slowQueryThreshold = threshold
+	}
+}
+
+// WithSlowQueryHandler sets the handler of the slow queries.
+func WithSlowQueryHandler(handler SlowQueryHandler) Option {
+	return func(c *PgsqlConnector) {
+		c.slowQueryHandler = handler
+	}
+}
+
+// WithSlowQueryPlans captures the plan of the slow queries and execs asynchronously, on another
+// connection of the tenant, before the handler receives them. EXPLAIN does not run the statement.
+// CockroachDB has no EXPLAIN (FORMAT JSON), its slow queries come with a PlanErr.
+func WithSlowQueryPlans() Option {
+	return func(c *PgsqlConnector) {
+		c.explainSlots = make(chan struct{}, maxConcurrentExplains)
+	}
+}
+
+// slowQuery reports a slow statement, capturing its plan when asked and possible.
+func (p *PgsqlDatabase) slowQuery(event dbconnector.TraceEvent, args []interface{}, explainable bool) {
+	c := p.connector
+	query := SlowQuery{
+		TenantID:     event.TenantID,
+		Op:           event.Op,
+		SQL:          c.normalizedQueries.get(event.SQL).sql,
+		Duration:     event.Duration,
+		RowsAffected: event.RowsAffected,
+		Err:          event.Err,
+	}
+	c.logger.Warn("slow query", "tenant", query.TenantID, "op", string(query.Op), "sql", query.SQL,
+		"duration", query.Duration, "rows", query.RowsAffected)
+	if c.slowQueryHandler == nil {
+		return
+	}
+	if !explainable || c.explainSlots == nil {
+		c.slowQueryHandler(query)
+		return
+	}
+	select {
+	case c.explainSlots <- struct{}{}:
+	default:
+		// too many plans are being captured already
+		c.slowQueryHandler(query)
+		return
+	}
+	config, databaseURL, readOnly := p.config, p.databaseURL, p.readOnly
+	go func() {
+		defer func() { <-c.explainSlots }()
+		query.Plan, query.PlanErr = c.explain(config, databaseURL, readOnly, event.SQL, args)
+		c.slowQueryHandler(query)
+	}()
+}
+
+// explain captures the plan of a statement on a connection with the session settings of the tenant.
+// The capture is not a connection of the tenant: it is neither traced nor counted in its pool
+// statistics. It is skipped when the pool of the statement was closed meanwhile, by an eviction,
+// a reload or the connector, and under a connection budget when no lease is free right away.
+func (c *PgsqlConnector) explain(config dbconnector.TenantConfig, databaseURL string, readOnly bool, sql string, args []interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultExplainTimeout)
+	defer cancel()
+	pool, ok := c.livePool(databaseURL)
+	if !ok {
+		return nil, errors.New("plan not captured, the pool of the statement is closed")
+	}
+	if c.budget != nil {
+		release, ok := c.budget.tryReserve(databaseURL, config)
+		if !ok {
+			return nil, errors.New("plan not captured, the connection budget is exhausted")
+		}
+		defer release()
+	}
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	session, _ := c.sessionSettings(config, readOnly)
+	if err := applySession(ctx, conn.Conn(), session); err != nil {
+		// the pool destroys closed connections on release
+		_ = conn.Conn().Close(ctx)
+		return nil, err
+	}
+	defer func() { _ = resetSession(conn, session) }()
+
+	var plan []byte
+	if err := conn.QueryRow(ctx, "explain (format json) "+sql, args...).Scan(&plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
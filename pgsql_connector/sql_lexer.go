@@ -0,0 +1,298 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import "strings"
+
+// sqlTokenKind classifies the tokens produced by scanSQL.
+type sqlTokenKind int
+
+const (
+	// sqlOther is whitespace, an operator or punctuation.
+	sqlOther sqlTokenKind = iota
+	// sqlWord is a keyword or an unquoted identifier.
+	sqlWord
+	// sqlString is a string literal, including escape and dollar-quoted strings.
+	sqlString
+	// sqlQuotedIdent is a double-quoted identifier.
+	sqlQuotedIdent
+	// sqlComment is a line or block comment.
+	sqlComment
+	// sqlNamedParam is a :name or @name placeholder.
+	sqlNamedParam
+	// sqlPositionalParam is a $n placeholder.
+	sqlPositionalParam
+)
+
+// sqlToken is a lexical token of a SQL statement.
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+}
+
+// scanSQL splits a PostgreSQL statement into tokens. It only understands as much
+// of the grammar as needed to tell code apart from literals and comments.
+func scanSQL(query string) []sqlToken {
+	var tokens []sqlToken
+	// brackets is the depth of array subscripts, where a colon separates the slice bounds
+	brackets := 0
+	i := 0
+	for i < len(query) {
+		start := i
+		kind := sqlOther
+		c := query[i]
+		switch {
+		case c == '\'':
+			kind, i = sqlString, scanQuoted(query, i, '\'', false)
+		case c == '"':
+			kind, i = sqlQuotedIdent, scanQuoted(query, i, '"', false)
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			kind = sqlComment
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			kind, i = sqlComment, scanBlockComment(query, i)
+		case c == ':' && strings.HasPrefix(query[i:], "::"):
+			// type cast, never a placeholder
+			i += 2
+		case c == ':' && brackets > 0 && (followsOperand(tokens) || i+1 == len(query) || !isIdentStart(query[i+1])):
+			// slice bounds, as in arr[1:n] or arr[1:], while arr[:n] binds n
+			i++
+		case c == '@' && inOperator(query, i):
+			// part of an operator, as in @@, <@ or @-@
+			i++
+		case (c == ':' || c == '@') && i+1 < len(query) && isIdentStart(query[i+1]):
+			i += 2
+			for i < len(query) && isIdentChar(query[i]) && query[i] != '$' {
+				i++
+			}
+			kind = sqlNamedParam
+		case c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			i++
+			for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+				i++
+			}
+			kind = sqlPositionalParam
+		case c == '$' && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			kind = sqlString
+			if end := strings.Index(query[i+len(tag):], tag); end >= 0 {
+				i += len(tag) + end + len(tag)
+			} else {
+				i = len(query)
+			}
+		case isIdentStart(c):
+			i++
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			kind = sqlWord
+			// E'...' strings accept backslash escapes
+			if i < len(query) && query[i] == '\'' {
+				kind, i = sqlString, scanQuoted(query, i, '\'', i-start == 1 && (c == 'e' || c == 'E'))
+			}
+		default:
+			switch c {
+			case '[':
+				brackets++
+			case ']':
+				brackets = max(brackets-1, 0)
+			}
+			i++
+		}
+		tokens = append(tokens, sqlToken{kind: kind, text: query[start:i], pos: start})
+	}
+	return tokens
+}
+
+// scanQuoted returns the position right after the quoted text starting at pos.
+func scanQuoted(query string, pos int, quote byte, backslashEscapes bool) int {
+	i := pos + 1
+	for i < len(query) {
+		switch query[i] {
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+			} else {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(query)
+}
+
+// scanBlockComment returns the position right after the (possibly nested) block comment starting at pos.
+func scanBlockComment(query string, pos int) int {
+	depth := 0
+	i := pos
+	for i < len(query) {
+		switch {
+		case strings.HasPrefix(query[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(query[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(query)
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string ($$ or $tag$), or "" if s does not start with one.
+func dollarTag(s string) string {
+	if len(s) < 2 || s[0] != '$' {
+		return ""
+	}
+	if s[1] == '$' {
+		return "$$"
+	}
+	if !isIdentStart(s[1]) {
+		return ""
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] == '$' {
+			return s[:i+1]
+		}
+		if !isIdentChar(s[i]) {
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+// inOperator reports whether the @ at pos continues an operator (@@, @@@, <@ or @-@)
+// rather than starting a placeholder.
+func inOperator(query string, pos int) bool {
+	return strings.HasSuffix(query[:pos], "@") || strings.HasSuffix(query[:pos], "<") || strings.HasSuffix(query[:pos], "@-")
+}
+
+// followsOperand reports whether the last token, whitespace aside, can be the lower bound of a slice:
+// a number, an identifier, a placeholder or a closing bracket.
+func followsOperand(tokens []sqlToken) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		token := tokens[i]
+		switch {
+		case token.kind == sqlOther && strings.TrimSpace(token.text) == "":
+			continue
+		case token.kind == sqlOther:
+			return isDigit(token.text[0]) || token.text == "]" || token.text == ")"
+		default:
+			return token.kind == sqlWord || token.kind == sqlQuotedIdent || token.kind == sqlNamedParam || token.kind == sqlPositionalParam
+		}
+	}
+	return false
+}
+
+// hasTopLevelKeyword reports whether the statement uses the given keyword outside parentheses,
+// literals and comments, i.e. in the statement itself rather than in a subquery or a CTE.
+func hasTopLevelKeyword(tokens []sqlToken, keyword string) bool {
+	depth := 0
+	for _, token := range tokens {
+		switch {
+		case token.kind == sqlOther && token.text == "(":
+			depth++
+		case token.kind == sqlOther && token.text == ")":
+			depth--
+		case token.kind == sqlWord && depth == 0 && strings.EqualFold(token.text, keyword):
+			return true
+		}
+	}
+	return false
+}
+
+// trimStatement drops trailing whitespace, comments and semicolons so that clauses can be appended.
+func trimStatement(query string, tokens []sqlToken) string {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		token := tokens[i]
+		if token.kind == sqlComment || (token.kind == sqlOther && strings.TrimSpace(token.text) == "") || token.text == ";" {
+			continue
+		}
+		return query[:token.pos+len(token.text)]
+	}
+	return ""
+}
+
+// normalizeSQL strips the comments and literals of a statement, so that statements that only
+// differ in their values look the same: literals and placeholders become ?, whitespace is
+// collapsed and keywords and unquoted identifiers are lower-cased.
+func normalizeSQL(query string) string {
+	var normalized strings.Builder
+	space := false
+	write := func(text string) {
+		if space && normalized.Len() > 0 {
+			normalized.WriteByte(' ')
+		}
+		space = false
+		normalized.WriteString(text)
+	}
+	tokens := scanSQL(query)
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case token.kind == sqlComment:
+			space = true
+		case token.kind == sqlOther && strings.TrimSpace(token.text) == "":
+			space = true
+		case token.kind == sqlWord:
+			write(strings.ToLower(token.text))
+		case token.kind == sqlString, token.kind == sqlPositionalParam, token.kind == sqlNamedParam:
+			write("?")
+		case token.kind == sqlOther && isDigit(token.text[0]):
+			// numbers are scanned one character at a time
+			for i+1 < len(tokens) && tokens[i+1].kind == sqlOther && (isDigit(tokens[i+1].text[0]) || tokens[i+1].text == ".") {
+				i++
+			}
+			write("?")
+		default:
+			write(token.text)
+		}
+	}
+	return normalized.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,118 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReturningQuery(t *testing.T) {
+
+	t.Run("Test append RETURNING", func(t *testing.T) {
+		assert.Equal(t, `insert into t (name) values ($1) RETURNING "id"`,
+			returningQuery("insert into t (name) values ($1);\n", DefaultIDColumn))
+		assert.Equal(t, `insert into t (name) values ($1) RETURNING "id"`,
+			returningQuery("insert into t (name) values ($1) -- new row", DefaultIDColumn))
+	})
+
+	t.Run("Test honor RETURNING", func(t *testing.T) {
+		query := "insert into t (name) values ($1) returning uid"
+		assert.Equal(t, query, returningQuery(query, DefaultIDColumn))
+	})
+
+	t.Run("Test RETURNING inside literals and comments", func(t *testing.T) {
+		query := "insert into t (name, note) values ('returning', $$returning$$) /* returning */"
+		assert.Equal(t, `insert into t (name, note) values ('returning', $$returning$$) RETURNING "id"`,
+			returningQuery(query, DefaultIDColumn))
+		query = `insert into t ("returning") values (E'it\'s returning')`
+		assert.Equal(t, query+` RETURNING "id"`, returningQuery(query, DefaultIDColumn))
+	})
+
+	t.Run("Test RETURNING inside a CTE", func(t *testing.T) {
+		query := "with d as (delete from old returning *) insert into t (name) select name from d"
+		assert.Equal(t, query+` RETURNING "id"`, returningQuery(query, DefaultIDColumn))
+		query = "with d as (delete from old returning *) insert into t (name) select name from d returning uid"
+		assert.Equal(t, query, returningQuery(query, DefaultIDColumn))
+	})
+}
+
+func TestInsertKey(t *testing.T) {
+	assert.Equal(t, int64(7), insertKey(int32(7)))
+	assert.Equal(t, int64(7), insertKey(int64(7)))
+	assert.Equal(t, "0f4b6bd2-9d4c-4c1a-8a3e-5a1b2c3d4e5f", insertKey([16]byte{
+		0x0f, 0x4b, 0x6b, 0xd2, 0x9d, 0x4c, 0x4c, 0x1a, 0x8a, 0x3e, 0x5a, 0x1b, 0x2c, 0x3d, 0x4e, 0x5f,
+	}))
+	assert.Equal(t, "key", insertKey("key"))
+}
+
+func TestNormalizeSQL(t *testing.T) {
+	assert.Equal(t, "select * from users where id = ? and name = ?",
+		normalizeSQL("SELECT *\n  FROM Users -- all users\n WHERE id = 42 AND name = 'bob'"))
+	assert.Equal(t, `insert into t ("Name", n) values (?, ?, ?)`,
+		normalizeSQL(`insert into t ("Name", n) values ($1, :name, 3.14)`))
+	assert.Equal(t, "select t1.x::int from t1", normalizeSQL("select t1.x::int from t1 /* hint */"))
+	assert.Equal(t, "select ? where ?", normalizeSQL("select $$it's$$ /* c */ where E'a\\'b'"))
+}
+
+func TestScanNamedParams(t *testing.T) {
+	namedParams := func(query string) []string {
+		var params []string
+		for _, token := range scanSQL(query) {
+			if token.kind == sqlNamedParam {
+				params = append(params, token.text)
+			}
+		}
+		return params
+	}
+
+	t.Run("Test placeholders", func(t *testing.T) {
+		assert.Equal(t, []string{":id", "@name"}, namedParams("select * from t where id = :id and name = @name"))
+		assert.Equal(t, []string{":tags"}, namedParams("select x::text from t where tags && :tags"))
+	})
+
+	t.Run("Test operators", func(t *testing.T) {
+		assert.Empty(t, namedParams("select * from docs where body @@ to_tsquery('cats')"))
+		assert.Empty(t, namedParams("select * from docs where body @@to_tsquery('cats')"))
+		assert.Empty(t, namedParams("select * from t where tags @>tags2 or tags <@tags2"))
+		assert.Equal(t, []string{"@query"}, namedParams("select * from docs where body @@ @query"))
+		assert.Empty(t, namedParams("select * from docs where body @@@ query or p @-@p2 or j @?path or j @> j2"))
+		assert.Equal(t, []string{"@id"}, namedParams("select * from t where id=@id"))
+		assert.Equal(t, []string{"@lim", "@lo", "@hi"}, namedParams("select * from t where x<=@lim and y>@lo and z+@hi > 0"))
+	})
+
+	t.Run("Test array slices", func(t *testing.T) {
+		assert.Empty(t, namedParams("select arr[1:n], arr[lo:hi] from t"))
+		assert.Equal(t, []string{":n"}, namedParams("select arr[1:n] from t limit :n"))
+		assert.Empty(t, namedParams("select arr[1:2], arr[1:], arr[1 : 2], m[1][2:3] from t"))
+		assert.Equal(t, []string{":n"}, namedParams("select arr[:n] from t"))
+		assert.Equal(t, []string{":lo"}, namedParams("select arr[:lo:hi] from t"))
+	})
+
+	t.Run("Test array constructors", func(t *testing.T) {
+		assert.Equal(t, []string{":a", ":b"}, namedParams("select * from t where id = any(array[:a, :b])"))
+		assert.Equal(t, []string{":a", ":b"}, namedParams("select * from t where id = any(ARRAY[:a,:b])"))
+	})
+}
@@ -0,0 +1,277 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// statementRegistry holds the statements prepared on every tenant connection.
+type statementRegistry struct {
+	mu         sync.RWMutex
+	statements map[string]*namedQuery
+}
+
+func newStatementRegistry() *statementRegistry {
+	return &statementRegistry{statements: make(map[string]*namedQuery)}
+}
+
+// get returns a registered statement.
+func (r *statementRegistry) get(name string) (*namedQuery, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statement, ok := r.statements[name]
+	return statement, ok
+}
+
+// all returns the registered statements by name.
+func (r *statementRegistry) all() map[string]*namedQuery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statements := make(map[string]*namedQuery, len(r.statements))
+	for name, statement := range r.statements {
+		statements[name] = statement
+	}
+	return statements
+}
+
+// RegisterStatement declares a statement that is prepared on every new tenant connection
+// and invoked by name through QueryStatement, QueryRowStatement and ExecStatement.
+// The statement may use positional or named placeholders. A name cannot be registered
+// twice with different SQL, since connections may already have it prepared.
+func (c *PgsqlConnector) RegisterStatement(name, sql string) error {
+	if name == "" {
+		return errors.New("statement name cannot be empty")
+	}
+	statement, err := parseNamedQuery(sql)
+	if err != nil {
+		// positional placeholders only
+		statement = &namedQuery{sql: sql}
+	}
+
+	c.statements.mu.Lock()
+	defer c.statements.mu.Unlock()
+	if registered, ok := c.statements.statements[name]; ok && registered.sql != statement.sql {
+		return fmt.Errorf("statement %q is already registered with a different query", name)
+	}
+	c.statements.statements[name] = statement
+	return nil
+}
+
+// prepareStatements prepares the registered statements on a new connection.
+// Statements that cannot be prepared yet (e.g. their tables do not exist)
+// are prepared again when invoked.
+func (c *PgsqlConnector) prepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, statement := range c.statements.all() {
+		_, _ = conn.Prepare(ctx, name, statement.sql)
+	}
+	return nil
+}
+
+// isStalePlanError reports whether a prepared statement was invalidated by a schema change or dropped from the session.
+func isStalePlanError(err error) bool {
+	var pgError *pgconn.PgError
+	if !errors.As(err, &pgError) {
+		return false
+	}
+	switch pgError.Code {
+	case "0A000": // cached plan must not change result type
+		return pgError.Message == "cached plan must not change result type"
+	case "26000": // invalid_sql_statement_name
+		return true
+	}
+	return false
+}
+
+// statementArgs makes sure a registered statement is prepared on conn and returns its arguments,
+// binding named arguments when needed.
+func (p *PgsqlDatabase) statementArgs(ctx context.Context, conn *pgx.Conn, name string, args []interface{}) ([]interface{}, error) {
+	statement, ok := p.connector.statements.get(name)
+	if !ok {
+		return nil, errorex.New(dbconnector.ErrCodeUnknownStatement, dbconnector.StatementErrorDetail{
+			TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
+			StatementName:     name,
+		})
+	}
+	if _, err := conn.Prepare(ctx, name, statement.sql); err != nil {
+		return nil, p.queryError(err, statement.sql, args)
+	}
+
+	binder, ok := namedArgsBinder(args)
+	if !ok || len(statement.names) == 0 {
+		return args, nil
+	}
+	bound := make([]interface{}, len(statement.names))
+	for i, argName := range statement.names {
+		value, ok := binder.NamedArg(argName)
+		if !ok {
+			return nil, errorex.New(dbconnector.ErrCodeInvalidQueryArgs,
+				dbconnector.QueryErrorDetail{
+					DatabaseErrorDetail: dbconnector.DatabaseErrorDetail{
+						TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: p.TenantConfig().TenantID()},
+						DatabaseError:     fmt.Sprintf("missing value for named argument %q", argName),
+					},
+					QueryScript: statement.sql,
+					QueryArgs:   args,
+				},
+			)
+		}
+		bound[i] = value
+	}
+	return bound, nil
+}
+
+// statementSQL returns the SQL of a registered statement, for tracing.
+func (p *PgsqlDatabase) statementSQL(name string) string {
+	if statement, ok := p.connector.statements.get(name); ok {
+		return statement.sql
+	}
+	return name
+}
+
+// statementFailed drops a statement whose plan went stale, so it is prepared again on its next use.
+// When it cannot be dropped, e.g. in an aborted transaction, the connection is not reused.
+func (p *PgsqlDatabase) statementFailed(conn *pgx.Conn, name string, err error) {
+	if !isStalePlanError(err) {
+		return
+	}
+	if err := conn.Deallocate(context.Background(), name); err != nil {
+		p.Logger().Warn("stale statement not deallocated, connection discarded", "statement", name, "error", err)
+		p.discard = true
+	}
+}
+
+// QueryStatement executes a registered statement and returns the result.
+func (p *PgsqlDatabase) QueryStatement(ctx context.Context, name string, args ...interface{}) (dbconnector.Rows, error) {
+	return p.queryStatement(ctx, p.PgxConn(), name, args)
+}
+
+// QueryRowStatement executes a registered statement that is expected to return at most one row.
+func (p *PgsqlDatabase) QueryRowStatement(ctx context.Context, name string, args ...interface{}) dbconnector.Row {
+	return p.queryRowStatement(ctx, p.PgxConn(), name, args)
+}
+
+// ExecStatement executes a registered statement outside a transaction.
+// A statement invalidated by a schema change is prepared again and retried once.
+func (p *PgsqlDatabase) ExecStatement(ctx context.Context, name string, args ...interface{}) (dbconnector.Result, error) {
+	result, err := p.execStatement(ctx, p.PgxConn(), name, args)
+	if err != nil && isStalePlanError(err) {
+		result, err = p.execStatement(ctx, p.PgxConn(), name, args)
+	}
+	return result, err
+}
+
+// QueryStatement executes a registered statement and returns the result.
+func (p *PgsqlTransaction) QueryStatement(ctx context.Context, name string, args ...interface{}) (dbconnector.Rows, error) {
+	return p.database.queryStatement(ctx, p.tx.Conn(), name, args)
+}
+
+// QueryRowStatement executes a registered statement that is expected to return at most one row.
+func (p *PgsqlTransaction) QueryRowStatement(ctx context.Context, name string, args ...interface{}) dbconnector.Row {
+	return p.database.queryRowStatement(ctx, p.tx.Conn(), name, args)
+}
+
+// ExecStatement executes a registered statement.
+func (p *PgsqlTransaction) ExecStatement(ctx context.Context, name string, args ...interface{}) (dbconnector.Result, error) {
+	return p.database.execStatement(ctx, p.tx.Conn(), name, args)
+}
+
+func (p *PgsqlDatabase) queryStatement(ctx context.Context, conn *pgx.Conn, name string, args []interface{}) (dbconnector.Rows, error) {
+	args, err := p.statementArgs(ctx, conn, name, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, end := p.traceStatement(ctx, dbconnector.TraceQuery, p.statementSQL(name), args)
+	rows, err := conn.Query(ctx, name, args...)
+	if err != nil {
+		end(0, err)
+		p.statementFailed(conn, name, err)
+		return nil, p.queryError(err, name, args)
+	}
+	return &pgsqlRows{
+		rows: rows,
+		onError: func(err error) {
+			p.statementFailed(conn, name, err)
+		},
+		end: end,
+	}, nil
+}
+
+func (p *PgsqlDatabase) queryRowStatement(ctx context.Context, conn *pgx.Conn, name string, args []interface{}) dbconnector.Row {
+	args, err := p.statementArgs(ctx, conn, name, args)
+	if err != nil {
+		return &errorRow{err: err}
+	}
+	ctx, end := p.traceStatement(ctx, dbconnector.TraceQuery, p.statementSQL(name), args)
+	return &statementRow{
+		row: p.traceRow(conn.QueryRow(ctx, name, args...), end),
+		onError: func(err error) {
+			p.statementFailed(conn, name, err)
+		},
+	}
+}
+
+func (p *PgsqlDatabase) execStatement(ctx context.Context, conn *pgx.Conn, name string, args []interface{}) (dbconnector.Result, error) {
+	if err := p.checkWritable(); err != nil {
+		return nil, err
+	}
+	args, err := p.statementArgs(ctx, conn, name, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, end := p.traceStatement(ctx, dbconnector.TraceExec, p.statementSQL(name), args)
+	result, err := conn.Exec(ctx, name, args...)
+	end(result.RowsAffected(), err)
+	if err != nil {
+		p.statementFailed(conn, name, err)
+		return nil, err
+	}
+	return &PgsqlResult{
+		database: p,
+		result:   result,
+	}, nil
+}
+
+// statementRow is the row of a registered statement.
+type statementRow struct {
+	row     pgx.Row
+	onError func(err error)
+}
+
+func (r *statementRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if err != nil {
+		r.onError(err)
+	}
+	return err
+}
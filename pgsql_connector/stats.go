@@ -0,0 +1,153 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Backend names the connector in the pool statistics.
+const Backend = "pgsql"
+
+// failureKey identifies the pools of a tenant in one role.
+type failureKey struct {
+	tenantID string
+	role     string
+}
+
+// failureCounter counts the connections that could not be acquired.
+type failureCounter struct {
+	mu     sync.Mutex
+	counts map[failureKey]int64
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{counts: make(map[failureKey]int64)}
+}
+
+func (f *failureCounter) add(key failureKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[key]++
+}
+
+func (f *failureCounter) get(key failureKey) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[key]
+}
+
+// retain forgets the tenants that are gone.
+func (f *failureCounter) retain(tenantIDs map[string]int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.counts {
+		if _, ok := tenantIDs[key.tenantID]; !ok {
+			delete(f.counts, key)
+		}
+	}
+}
+
+// poolRole returns the role of the pool of databaseURL for a tenant.
+func poolRole(config dbconnector.TenantConfig, databaseURL string) string {
+	if databaseURL == config.DatabaseURL() {
+		return dbconnector.PoolRolePrimary
+	}
+	return dbconnector.PoolRoleReplica
+}
+
+// Stats returns the statistics of the primary pool of each current tenant and, for tenants
+// with read replicas, of their replica pools, sorted by tenant ID and role. A shared pool is
+// reported under the first of its tenants by ID only.
+func (c *PgsqlConnector) Stats() []dbconnector.PoolStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	configs := append([]dbconnector.TenantConfig(nil), c.tenantsConfig...)
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].TenantID() < configs[j].TenantID()
+	})
+	reported := make(map[*pgxpool.Pool]bool)
+	addPool := func(stats *dbconnector.PoolStats, databaseURL string) {
+		pool := c.pools[databaseURL]
+		if reported[pool] {
+			return
+		}
+		reported[pool] = true
+		addPoolStat(stats, pool)
+	}
+
+	stats := make([]dbconnector.PoolStats, 0, len(configs))
+	for _, config := range configs {
+		primary := c.newPoolStats(config.TenantID(), dbconnector.PoolRolePrimary)
+		addPool(&primary, config.DatabaseURL())
+		stats = append(stats, primary)
+
+		replicaURLs := dbconnector.TenantReplicaURLs(config)
+		if len(replicaURLs) == 0 {
+			continue
+		}
+		replica := c.newPoolStats(config.TenantID(), dbconnector.PoolRoleReplica)
+		for _, replicaURL := range replicaURLs {
+			addPool(&replica, replicaURL)
+		}
+		stats = append(stats, replica)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TenantID != stats[j].TenantID {
+			return stats[i].TenantID < stats[j].TenantID
+		}
+		return stats[i].Role < stats[j].Role
+	})
+	return stats
+}
+
+func (c *PgsqlConnector) newPoolStats(tenantID, role string) dbconnector.PoolStats {
+	return dbconnector.PoolStats{
+		TenantID:        tenantID,
+		Backend:         Backend,
+		Role:            role,
+		AcquireFailures: c.acquireFailures.get(failureKey{tenantID: tenantID, role: role}),
+	}
+}
+
+// addPoolStat adds the statistics of a pool, if it was created already.
+func addPoolStat(stats *dbconnector.PoolStats, pool *pgxpool.Pool) {
+	if pool == nil {
+		return
+	}
+	stat := pool.Stat()
+	stats.AcquiredConns += stat.AcquiredConns()
+	stats.IdleConns += stat.IdleConns()
+	stats.TotalConns += stat.TotalConns()
+	stats.MaxConns += stat.MaxConns()
+	stats.AcquireCount += stat.AcquireCount()
+	stats.WaitCount += stat.EmptyAcquireCount()
+	stats.WaitDuration += stat.AcquireDuration()
+}
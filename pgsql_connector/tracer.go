@@ -0,0 +1,163 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package pgsql_connector
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WithTracer traces the connections, statements and transactions of the tenants.
+func WithTracer(tracer dbconnector.Tracer) Option {
+	return func(c *PgsqlConnector) {
+		c.tracer = tracer
+	}
+}
+
+// endTrace ends a traced operation.
+type endTrace func(rowsAffected int64, err error)
+
+func noTrace(int64, error) {}
+
+// startTrace starts tracing an operation, the returned context must be passed on to it.
+// The statements of the tenants are aggregated in the query statistics, onSlow receives
+// them when they last at least the slow query threshold.
+func (c *PgsqlConnector) startTrace(ctx context.Context, op dbconnector.TraceOp, tenantID, sql string, argCount int, statement bool, onSlow func(event dbconnector.TraceEvent)) (context.Context, endTrace) {
+	if !c.instrumented() {
+		return ctx, noTrace
+	}
+	event := dbconnector.TraceEvent{
+		Op:       op,
+		TenantID: tenantID,
+		SQL:      sql,
+		ArgCount: argCount,
+		Attempt:  dbconnector.AttemptFromContext(ctx),
+	}
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, event)
+	}
+	start := time.Now()
+	return ctx, func(rowsAffected int64, err error) {
+		event.RowsAffected = rowsAffected
+		event.Duration = time.Since(start)
+		event.Err = err
+		if c.tracer != nil {
+			c.tracer.TraceEnd(ctx, event)
+		}
+		if statement && c.queryStats != nil {
+			c.queryStats.record(event, c.normalizedQueries.get(event.SQL))
+		}
+		if onSlow != nil && c.slowQueryThreshold > 0 && event.Duration >= c.slowQueryThreshold {
+			onSlow(event)
+		}
+	}
+}
+
+// instrumented reports whether the operations are timed, for tracing, slow query detection or query statistics.
+func (c *PgsqlConnector) instrumented() bool {
+	return c.tracer != nil || c.slowQueryThreshold > 0 || c.queryStats != nil
+}
+
+// startTrace starts tracing a batch or copy of the tenant.
+func (p *PgsqlDatabase) startTrace(ctx context.Context, op dbconnector.TraceOp, sql string, argCount int) (context.Context, endTrace) {
+	if !p.connector.instrumented() {
+		return ctx, noTrace
+	}
+	return p.connector.startTrace(ctx, op, p.TenantConfig().TenantID(), sql, argCount, true, func(event dbconnector.TraceEvent) {
+		p.slowQuery(event, nil, false)
+	})
+}
+
+// traceStatement starts tracing a query or exec of the tenant, whose plan can be captured when it is slow.
+func (p *PgsqlDatabase) traceStatement(ctx context.Context, op dbconnector.TraceOp, sql string, args []interface{}) (context.Context, endTrace) {
+	if !p.connector.instrumented() {
+		return ctx, noTrace
+	}
+	return p.connector.startTrace(ctx, op, p.TenantConfig().TenantID(), sql, len(args), true, func(event dbconnector.TraceEvent) {
+		p.slowQuery(event, args, true)
+	})
+}
+
+// BeginTx begins a transaction on the connection. The begin, commit and rollback are traced.
+func (p *PgsqlDatabase) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	traceCtx, end := p.connector.startTrace(ctx, dbconnector.TraceBegin, p.TenantConfig().TenantID(), "begin", 0, false, nil)
+	tx, err := p.conn.BeginTx(traceCtx, txOptions)
+	end(0, err)
+	if err != nil || p.connector.tracer == nil {
+		return tx, err
+	}
+	return &tracedTx{Tx: tx, database: p}, nil
+}
+
+// tracedTx traces the commit and rollback of a transaction.
+type tracedTx struct {
+	pgx.Tx
+	database *PgsqlDatabase
+}
+
+func (t *tracedTx) Commit(ctx context.Context) error {
+	ctx, end := t.database.connector.startTrace(ctx, dbconnector.TraceCommit, t.database.TenantConfig().TenantID(), "commit", 0, false, nil)
+	err := t.Tx.Commit(ctx)
+	end(0, err)
+	return err
+}
+
+func (t *tracedTx) Rollback(ctx context.Context) error {
+	ctx, end := t.database.connector.startTrace(ctx, dbconnector.TraceRollback, t.database.TenantConfig().TenantID(), "rollback", 0, false, nil)
+	err := t.Tx.Rollback(ctx)
+	end(0, err)
+	return err
+}
+
+// tracedRow ends the trace of a query once its row is scanned.
+type tracedRow struct {
+	row pgx.Row
+	end endTrace
+}
+
+func (r *tracedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	switch {
+	case err == nil:
+		r.end(1, nil)
+	case errors.Is(err, pgx.ErrNoRows):
+		r.end(0, nil)
+	default:
+		r.end(0, err)
+	}
+	return err
+}
+
+// traceRow traces the row of a query, when a tracer is set.
+func (p *PgsqlDatabase) traceRow(row pgx.Row, end endTrace) dbconnector.Row {
+	if !p.connector.instrumented() {
+		return row
+	}
+	return &tracedRow{row: row, end: end}
+}
@@ -0,0 +1,365 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+// Package provision creates and removes the databases of the tenants, on Postgres and CockroachDB.
+package provision
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fkmatsuda/dbconnector"
+
+	"github.com/fkmatsuda/errorex"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultPrefix prefixes the name of the database or schema and owner role of the tenants.
+const DefaultPrefix = "tenant_"
+
+// Mode is the isolation of the provisioned tenants.
+type Mode int
+
+const (
+	// DatabasePerTenant creates a database for each tenant.
+	DatabasePerTenant Mode = iota
+	// SchemaPerTenant creates a schema for each tenant in the database of the admin connection.
+	SchemaPerTenant
+)
+
+// Template describes how the tenants are provisioned.
+type Template struct {
+	// Mode is the isolation of the tenants.
+	Mode Mode
+	// Prefix prefixes the names of the database or schema and owner role, DefaultPrefix when empty.
+	Prefix string
+	// Grants lists the roles granted all privileges on the database or schema of the tenant
+	// and on the tables and sequences created by its owner, e.g. a role of the application servers.
+	Grants []string
+	// Bootstrap lists the SQL scripts run by the owner once the tenant is created, e.g. the initial schema.
+	Bootstrap []string
+}
+
+// Tenant is the tenant to provision.
+type Tenant struct {
+	ID   string
+	Name string
+	// Password is the password of the owner role, which has no password when empty,
+	// e.g. with certificate authentication or an insecure CockroachDB cluster.
+	Password string
+	// Metadata is carried by the tenant config.
+	Metadata dbconnector.TenantMetadata
+}
+
+// Connector connects to a tenant config before it is registered in the tenant provider,
+// and lists the loaded tenants, whose databases and schemas are never deprovisioned.
+// It is implemented by pgsql_connector.PgsqlConnector and crdb_connector.CrdbConnector.
+type Connector interface {
+	ConnectConfig(ctx context.Context, tenantConfig dbconnector.TenantConfig) (dbconnector.Database, error)
+	Tenants() []dbconnector.TenantConfig
+}
+
+// Provisioner creates and removes tenants through an admin connection, which needs
+// the privileges to create databases or schemas and roles.
+type Provisioner struct {
+	admin     dbconnector.Database
+	connector Connector
+	template  Template
+}
+
+// New creates a provisioner. The connector runs the bootstrap scripts on the new tenants.
+func New(admin dbconnector.Database, connector Connector, template Template) *Provisioner {
+	if template.Prefix == "" {
+		template.Prefix = DefaultPrefix
+	}
+	return &Provisioner{
+		admin:     admin,
+		connector: connector,
+		template:  template,
+	}
+}
+
+// Provision creates the database or schema of the tenant, owned by a new login role, grants
+// the template roles and runs the bootstrap scripts. It returns the tenant config to register
+// in the tenant provider. What was created is dropped again when a step fails.
+func (p *Provisioner) Provision(ctx context.Context, tenant Tenant) (config dbconnector.TenantConfig, err error) {
+	name := p.objectName(tenant.ID)
+	owner := pgx.Identifier{name + "_owner"}.Sanitize()
+	object := pgx.Identifier{name}.Sanitize()
+	cockroach, err := isCockroach(ctx, p.admin)
+	if err != nil {
+		return nil, provisionFailed(tenant.ID, "detect backend", err)
+	}
+
+	// undo drops what was created, newest first
+	var undo []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			_, _ = dbconnector.Exec(context.WithoutCancel(ctx), p.admin, undo[i])
+		}
+	}()
+	step := func(stepName, sql string, undoSQL string) error {
+		if _, err := dbconnector.Exec(ctx, p.admin, sql); err != nil {
+			return provisionFailed(tenant.ID, stepName, err)
+		}
+		if undoSQL != "" {
+			undo = append(undo, undoSQL)
+		}
+		return nil
+	}
+
+	createRole := "create role " + owner + " with login"
+	if tenant.Password != "" {
+		createRole += " password " + quoteLiteral(tenant.Password)
+	}
+	if err := step("create owner role", createRole, dropRoleSQL(owner)); err != nil {
+		return nil, err
+	}
+
+	adminURL, err := url.Parse(p.admin.TenantConfig().DatabaseURL())
+	if err != nil {
+		return nil, provisionFailed(tenant.ID, "parse admin URL", err)
+	}
+	tenantURL := *adminURL
+	if tenant.Password != "" {
+		tenantURL.User = url.UserPassword(name+"_owner", tenant.Password)
+	} else {
+		tenantURL.User = url.User(name + "_owner")
+	}
+	builder := dbconnector.NewTenantConfigBuilder().
+		WithTenantID(tenant.ID).
+		WithTenantName(tenant.Name).
+		WithMetadata(tenant.Metadata)
+
+	defaultsSchema := "public"
+	switch p.template.Mode {
+	case DatabasePerTenant:
+		if err := step("create database", "create database "+object, dropDatabaseSQL(object, cockroach)); err != nil {
+			return nil, err
+		}
+		if err := step("set database owner", "alter database "+object+" owner to "+owner, ""); err != nil {
+			return nil, err
+		}
+		for _, role := range p.template.Grants {
+			grant := "grant all on database " + object + " to " + pgx.Identifier{role}.Sanitize()
+			if err := step("grant database", grant, ""); err != nil {
+				return nil, err
+			}
+		}
+		tenantURL.Path = "/" + name
+	case SchemaPerTenant:
+		if err := step("create schema", "create schema "+object+" authorization "+owner, "drop schema if exists "+object+" cascade"); err != nil {
+			return nil, err
+		}
+		for _, role := range p.template.Grants {
+			grant := "grant all on schema " + object + " to " + pgx.Identifier{role}.Sanitize()
+			if err := step("grant schema", grant, ""); err != nil {
+				return nil, err
+			}
+		}
+		builder = builder.WithSchema(name)
+		defaultsSchema = name
+	}
+	config = builder.WithDatabaseURL(tenantURL.String()).Build()
+
+	// the owner runs the bootstrap scripts, so it owns the objects they create
+	database, err := p.connector.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, provisionFailed(tenant.ID, "connect as owner", err)
+	}
+	defer database.Close(context.WithoutCancel(ctx))
+	for _, role := range p.template.Grants {
+		for _, objects := range []string{"tables", "sequences"} {
+			grant := "alter default privileges in schema " + pgx.Identifier{defaultsSchema}.Sanitize() +
+				" grant all on " + objects + " to " + pgx.Identifier{role}.Sanitize()
+			if _, err := dbconnector.Exec(ctx, database, grant); err != nil {
+				return nil, provisionFailed(tenant.ID, "grant default privileges", err)
+			}
+		}
+	}
+	for _, script := range p.template.Bootstrap {
+		if _, err := dbconnector.Exec(ctx, database, script); err != nil {
+			return nil, provisionFailed(tenant.ID, "bootstrap", err)
+		}
+	}
+	return config, nil
+}
+
+// Disposal is what Deprovision does with the data of the tenant.
+type Disposal int
+
+const (
+	// Archive renames the database or schema of the tenant and disables the login of its owner.
+	Archive Disposal = iota
+	// Drop drops the database or schema of the tenant and its owner.
+	Drop
+)
+
+// Deprovision removes a tenant created by Provision, as described by its config, and returns
+// the archived name of the database or schema, <name>_archived_<yyyymmddhhmmss>, when archived.
+// The tenant should be removed from the tenant provider first: its open connections are terminated.
+// It fails when another loaded tenant points at the same database or schema.
+func (p *Provisioner) Deprovision(ctx context.Context, config dbconnector.TenantConfig, disposal Disposal) (string, error) {
+	tenantID := config.TenantID()
+	tenantURL, err := url.Parse(config.DatabaseURL())
+	if err != nil {
+		return "", provisionFailed(tenantID, "parse tenant URL", err)
+	}
+	cockroach, err := isCockroach(ctx, p.admin)
+	if err != nil {
+		return "", provisionFailed(tenantID, "detect backend", err)
+	}
+
+	owner := pgx.Identifier{tenantURL.User.Username()}.Sanitize()
+	schema := dbconnector.TenantSchema(config)
+	name, kind := schema, "schema"
+	if name == "" {
+		name, kind = strings.TrimPrefix(tenantURL.Path, "/"), "database"
+	}
+	if shared := p.sharedWith(config, tenantURL, schema); shared != "" {
+		return "", provisionFailed(tenantID, "check tenants", fmt.Errorf("%s %s is used by tenant %s", kind, name, shared))
+	}
+	if kind == "database" && !cockroach {
+		// Postgres cannot rename or drop a database while connected to it
+		_, err := dbconnector.Exec(ctx, p.admin, "select pg_terminate_backend(pid) from pg_stat_activity where datname = $1 and pid <> pg_backend_pid()", name)
+		if err != nil {
+			return "", provisionFailed(tenantID, "terminate connections", err)
+		}
+	}
+	object := pgx.Identifier{name}.Sanitize()
+
+	var statements []string
+	archived := ""
+	switch disposal {
+	case Archive:
+		archived = name + "_archived_" + time.Now().UTC().Format("20060102150405")
+		statements = []string{
+			"alter role " + owner + " with nologin",
+			"alter " + kind + " " + object + " rename to " + pgx.Identifier{archived}.Sanitize(),
+		}
+	case Drop:
+		if kind == "database" {
+			statements = []string{dropDatabaseSQL(object, cockroach)}
+		} else {
+			statements = []string{"drop schema if exists " + object + " cascade"}
+		}
+		statements = append(statements, dropRoleSQL(owner))
+	}
+	for _, statement := range statements {
+		if _, err := dbconnector.Exec(ctx, p.admin, statement); err != nil {
+			return "", provisionFailed(tenantID, "deprovision "+kind, err)
+		}
+	}
+	return archived, nil
+}
+
+// maxNameLength leaves room in a Postgres identifier, 63 bytes at most, for the longest
+// suffix added to an object name: _archived_<yyyymmddhhmmss>.
+const maxNameLength = 63 - len("_archived_20060102150405")
+
+// objectName is the name of the database or schema of the tenant, its owner role adds _owner.
+// An ID that is not a short lower-case identifier is sanitized, shortened and followed by
+// a hash of the raw ID, so that distinct IDs such as a-b and a_b never share a name.
+func (p *Provisioner) objectName(tenantID string) string {
+	var b strings.Builder
+	b.WriteString(p.template.Prefix)
+	for _, r := range tenantID {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	name := b.String()
+	if name == p.template.Prefix+tenantID && len(name) <= maxNameLength {
+		return name
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(tenantID))
+	suffix := fmt.Sprintf("_%08x", hash.Sum32())
+	if len(name) > maxNameLength-len(suffix) {
+		name = name[:maxNameLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+// sharedWith returns the ID of another loaded tenant whose config points at the database
+// or schema of config, it would lose its data along with the deprovisioned tenant.
+func (p *Provisioner) sharedWith(config dbconnector.TenantConfig, tenantURL *url.URL, schema string) string {
+	for _, other := range p.connector.Tenants() {
+		if other.TenantID() == config.TenantID() {
+			continue
+		}
+		otherURL, err := url.Parse(other.DatabaseURL())
+		if err != nil || otherURL.Hostname() != tenantURL.Hostname() || otherURL.Path != tenantURL.Path {
+			continue
+		}
+		// a database is shared by every schema in it
+		if schema == "" || dbconnector.TenantSchema(other) == schema {
+			return other.TenantID()
+		}
+	}
+	return ""
+}
+
+func dropDatabaseSQL(object string, cockroach bool) string {
+	if cockroach {
+		return "drop database if exists " + object + " cascade"
+	}
+	return "drop database if exists " + object + " with (force)"
+}
+
+// dropRoleSQL drops the owner role, along with its privileges and default privileges,
+// which would keep it alive otherwise.
+func dropRoleSQL(owner string) string {
+	return "drop owned by " + owner + "; drop role if exists " + owner
+}
+
+func isCockroach(ctx context.Context, database dbconnector.Database) (bool, error) {
+	var version string
+	if err := database.QueryRow(ctx, "select version()").Scan(&version); err != nil {
+		return false, err
+	}
+	return strings.Contains(version, "CockroachDB"), nil
+}
+
+// quoteLiteral quotes a string literal, for the statements that take no parameters.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func provisionFailed(tenantID, step string, err error) error {
+	return errorex.New(dbconnector.ErrCodeProvisionFailed, dbconnector.ProvisionErrorDetail{
+		TenantErrorDetail: dbconnector.TenantErrorDetail{TenantID: tenantID},
+		Step:              step,
+		Cause:             dbconnector.AsEX(tenantID, err),
+	})
+}
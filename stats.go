@@ -0,0 +1,85 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import "time"
+
+// Roles of the connection pools of a tenant.
+const (
+	PoolRolePrimary = "primary"
+	PoolRoleReplica = "replica"
+)
+
+// PoolStatsReporter is implemented by connectors that report the statistics of their pools.
+type PoolStatsReporter interface {
+	// Stats returns a snapshot of the connection pools of the current tenants.
+	Stats() []PoolStats
+}
+
+// PoolStats is a snapshot of the connection pools of a tenant in one role. The replica pools
+// of a tenant are summed up. A pool shared by tenants with the same database URL is reported
+// once, under the first of them by tenant ID, so that the statistics add up across tenants.
+type PoolStats struct {
+	TenantID string
+	// Backend names the connector, such as pgsql or crdb.
+	Backend string
+	// Role is PoolRolePrimary or PoolRoleReplica.
+	Role          string
+	AcquiredConns int32
+	IdleConns     int32
+	TotalConns    int32
+	MaxConns      int32
+	// AcquireCount is the number of connections acquired successfully.
+	AcquireCount int64
+	// WaitCount is the number of acquires that had to wait for a connection.
+	WaitCount int64
+	// WaitDuration is the total time spent acquiring connections.
+	WaitDuration time.Duration
+	// AcquireFailures is the number of connections the tenant could not acquire.
+	AcquireFailures int64
+}
+
+// QueryStatsReporter is implemented by connectors that report the statistics of their statements.
+type QueryStatsReporter interface {
+	// QueryStats returns the statistics of the statements run by the tenants, when the connector
+	// collects them.
+	QueryStats() []QueryStats
+}
+
+// QueryStats aggregates the runs of a statement by a tenant, like pg_stat_statements does.
+type QueryStats struct {
+	TenantID string
+	// Backend names the connector, such as pgsql or crdb.
+	Backend string
+	// Fingerprint identifies the normalized statement.
+	Fingerprint string
+	// SQL is the normalized statement, without its literals.
+	SQL       string
+	Calls     int64
+	TotalTime time.Duration
+	MaxTime   time.Duration
+	// Rows is the total number of rows returned or affected.
+	Rows   int64
+	Errors int64
+}
@@ -0,0 +1,194 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TenantStatus is the operational status of a tenant.
+type TenantStatus string
+
+const (
+	// TenantStatusActive is the status of a tenant with full access.
+	TenantStatusActive TenantStatus = "active"
+	// TenantStatusSuspended is the status of a tenant whose access is blocked.
+	TenantStatusSuspended TenantStatus = "suspended"
+	// TenantStatusReadOnly is the status of a tenant that can only read.
+	TenantStatusReadOnly TenantStatus = "read-only"
+)
+
+// ConnectionSettings are the connection pool settings of a tenant.
+// Zero values keep the defaults of the pool.
+type ConnectionSettings struct {
+	// MaxConns is the maximum size of the pool.
+	MaxConns int32
+	// MinConns is the minimum size of the pool.
+	MinConns int32
+	// MaxConnLifetime is the duration after which a connection is closed.
+	MaxConnLifetime time.Duration
+	// MaxConnIdleTime is the duration after which an idle connection is closed.
+	MaxConnIdleTime time.Duration
+	// ConnectTimeout is the timeout to establish a connection.
+	ConnectTimeout time.Duration
+}
+
+// TenantMetadata holds the optional attributes of a tenant used for routing and operations.
+type TenantMetadata struct {
+	// Region is the region where the tenant is hosted.
+	Region string
+	// Tier is the service tier of the tenant.
+	Tier string
+	// Status is the operational status of the tenant.
+	Status TenantStatus
+	// Labels are arbitrary key/value pairs used to select tenants.
+	Labels map[string]string
+	// ConnectionSettings are the connection pool settings of the tenant.
+	ConnectionSettings ConnectionSettings
+}
+
+// TenantMetadataConfig is implemented by tenant configs that carry metadata.
+type TenantMetadataConfig interface {
+	// Metadata returns the metadata of the tenant.
+	Metadata() TenantMetadata
+}
+
+// TenantMetadataOf returns the metadata of the tenant. The status defaults to active.
+func TenantMetadataOf(config TenantConfig) TenantMetadata {
+	var metadata TenantMetadata
+	if metadataConfig, ok := config.(TenantMetadataConfig); ok {
+		metadata = metadataConfig.Metadata()
+	}
+	if metadata.Status == "" {
+		metadata.Status = TenantStatusActive
+	}
+	return metadata
+}
+
+// labelOperator is the operator of a label requirement.
+type labelOperator int
+
+const (
+	labelEquals labelOperator = iota
+	labelNotEquals
+	labelExists
+	labelNotExists
+)
+
+// labelRequirement is a single requirement of a LabelSelector.
+type labelRequirement struct {
+	key      string
+	operator labelOperator
+	value    string
+}
+
+// LabelSelector selects tenants by their labels. All requirements must match.
+// The empty selector matches every tenant.
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a comma separated list of requirements:
+// "key=value", "key!=value", "key" (the label exists) and "!key" (the label does not exist).
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var requirements LabelSelector
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		var requirement labelRequirement
+		switch {
+		case part == "":
+			continue
+		case strings.Contains(part, "!="):
+			key, value, _ := strings.Cut(part, "!=")
+			requirement = labelRequirement{key: strings.TrimSpace(key), operator: labelNotEquals, value: strings.TrimSpace(value)}
+		case strings.Contains(part, "="):
+			key, value, _ := strings.Cut(part, "=")
+			requirement = labelRequirement{key: strings.TrimSpace(key), operator: labelEquals, value: strings.TrimSpace(strings.TrimPrefix(value, "="))}
+		case strings.HasPrefix(part, "!"):
+			requirement = labelRequirement{key: strings.TrimSpace(part[1:]), operator: labelNotExists}
+		default:
+			requirement = labelRequirement{key: part, operator: labelExists}
+		}
+		if requirement.key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", selector)
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// SelectLabels returns a selector matching tenants that have all the given labels.
+func SelectLabels(labels map[string]string) LabelSelector {
+	requirements := make(LabelSelector, 0, len(labels))
+	for key, value := range labels {
+		requirements = append(requirements, labelRequirement{key: key, operator: labelEquals, value: value})
+	}
+	return requirements
+}
+
+// Matches reports whether the labels satisfy the selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, ok := labels[requirement.key]
+		switch requirement.operator {
+		case labelEquals:
+			if !ok || value != requirement.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && value == requirement.value {
+				return false
+			}
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FilterTenants returns the tenants whose labels satisfy the selector.
+func FilterTenants(tenants []TenantConfig, selector LabelSelector) []TenantConfig {
+	var selected []TenantConfig
+	for _, tenant := range tenants {
+		if selector.Matches(TenantMetadataOf(tenant).Labels) {
+			selected = append(selected, tenant)
+		}
+	}
+	return selected
+}
+
+// FindTenants returns the current tenants of the connector whose labels satisfy the selector,
+// none when the connector does not list its tenants (see TenantLister).
+func FindTenants(connector Connector, selector LabelSelector) []TenantConfig {
+	if lister, ok := connector.(TenantLister); ok {
+		return FilterTenants(lister.Tenants(), selector)
+	}
+	return nil
+}
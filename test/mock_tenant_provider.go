@@ -43,9 +43,11 @@ func (m *MockTenantProvider) LoadTenants() ([]dbconnector.TenantConfig, error) {
 }
 
 type mockTenantConfig struct {
-	id   string
-	name string
-	url  string
+	id       string
+	name     string
+	url      string
+	schema   string
+	metadata dbconnector.TenantMetadata
 }
 
 func (m *mockTenantConfig) TenantID() string {
@@ -60,6 +62,22 @@ func (m *mockTenantConfig) DatabaseURL() string {
 	return m.url
 }
 
+func (m *mockTenantConfig) Schema() string {
+	return m.schema
+}
+
+func (m *mockTenantConfig) Metadata() dbconnector.TenantMetadata {
+	return m.metadata
+}
+
 func NewMockTenantConfig(id, name, url string) dbconnector.TenantConfig {
-	return &mockTenantConfig{id, name, url}
+	return &mockTenantConfig{id: id, name: name, url: url}
+}
+
+func NewMockSchemaTenantConfig(id, name, url, schema string) dbconnector.TenantConfig {
+	return &mockTenantConfig{id: id, name: name, url: url, schema: schema}
+}
+
+func NewMockTenantConfigWithMetadata(id, name, url string, metadata dbconnector.TenantMetadata) dbconnector.TenantConfig {
+	return &mockTenantConfig{id: id, name: name, url: url, metadata: metadata}
 }
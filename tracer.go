@@ -0,0 +1,65 @@
+/*
+ *   Copyright (c) 2024 fkmatsuda <fabio@fkmatsuda.dev>
+ *   All rights reserved.
+
+ *   Permission is hereby granted, free of charge, to any person obtaining a copy
+ *   of this software and associated documentation files (the "Software"), to deal
+ *   in the Software without restriction, including without limitation the rights
+ *   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *   copies of the Software, and to permit persons to whom the Software is
+ *   furnished to do so, subject to the following conditions:
+
+ *   The above copyright notice and this permission notice shall be included in all
+ *   copies or substantial portions of the Software.
+
+ *   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *   SOFTWARE.
+ */
+
+package dbconnector
+
+import (
+	"context"
+	"time"
+)
+
+// TraceOp is the kind of a traced operation.
+type TraceOp string
+
+// Traced operations.
+const (
+	TraceConnect  TraceOp = "connect"
+	TraceQuery    TraceOp = "query"
+	TraceExec     TraceOp = "exec"
+	TraceBegin    TraceOp = "begin"
+	TraceCommit   TraceOp = "commit"
+	TraceRollback TraceOp = "rollback"
+	TraceBatch    TraceOp = "batch"
+	TraceCopy     TraceOp = "copy"
+)
+
+// TraceEvent describes a traced operation. The fields after Attempt are set when it ends.
+type TraceEvent struct {
+	Op       TraceOp
+	TenantID string
+	// SQL is the statement, after named arguments are bound.
+	SQL      string
+	ArgCount int
+	// Attempt is the attempt of the retried transaction the operation runs in, 0 outside of one.
+	Attempt      int
+	RowsAffected int64
+	Duration     time.Duration
+	Err          error
+}
+
+// Tracer observes the operations of the connectors. TraceStart may return a context that
+// carries a span, the operation runs with it and TraceEnd receives it.
+type Tracer interface {
+	TraceStart(ctx context.Context, event TraceEvent) context.Context
+	TraceEnd(ctx context.Context, event TraceEvent)
+}